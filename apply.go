@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ApplyResult lists the resources a declarative apply changes, as kind/name.
+type ApplyResult struct {
+	Created []string `json:"created"`
+	Updated []string `json:"updated"`
+	Deleted []string `json:"deleted"`
+}
+
+func (r ApplyResult) Empty() bool {
+	return len(r.Created) == 0 && len(r.Updated) == 0 && len(r.Deleted) == 0
+}
+
+// ParseState reads a desired state document, YAML or JSON, using the same
+// field names as the persisted State.
+func ParseState(data []byte) (State, error) {
+	state := NewState()
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return state, err
+	}
+	converted, err := json.Marshal(jsonCompatible(doc))
+	if err != nil {
+		return state, err
+	}
+	if err = json.Unmarshal(converted, &state); err != nil {
+		return state, err
+	}
+	normalize(state)
+	return state, nil
+}
+
+// jsonCompatible converts the maps produced by yaml into string keyed maps.
+func jsonCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprint(k)] = jsonCompatible(val)
+		}
+		return m
+	case []interface{}:
+		for i, val := range v {
+			v[i] = jsonCompatible(val)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// normalize fills in the names taken from map keys and the endpoint states
+// the control API would have set.
+func normalize(state State) {
+	for name, c := range state.Clusters {
+		if c == nil {
+			c = &Cluster{}
+			state.Clusters[name] = c
+		}
+		c.Name = name
+		for key, e := range c.Endpoints {
+			if e == nil {
+				e = &Endpoint{}
+				c.Endpoints[key] = e
+			}
+			if e.State == "" {
+				e.State = StateEnabled
+			}
+		}
+	}
+	for name, r := range state.RouteConf {
+		if r == nil {
+			r = &RouteConf{}
+			state.RouteConf[name] = r
+		}
+		r.Name = name
+		for vname, vh := range r.VirtualHosts {
+			if vh == nil {
+				vh = &VHost{}
+				r.VirtualHosts[vname] = vh
+			}
+			vh.Name = vname
+		}
+	}
+	for name, l := range state.Listeners {
+		if l == nil {
+			l = &Listener{}
+			state.Listeners[name] = l
+		}
+		l.Name = name
+	}
+	for name, g := range state.NodeGroups {
+		if g == nil {
+			g = &NodeGroup{}
+			state.NodeGroups[name] = g
+		}
+		g.Name = name
+	}
+}
+
+// Apply makes the configuration match desired. Resources missing from
+// desired are kept unless prune is set, like with PUT the endpoints, mirrors
+// and virtual hosts of a resource are kept unless it lists them. Nothing is
+// logged or published when desired matches the configuration already.
+func (cf Configuration) Apply(desired State, prune bool) (ApplyResult, error) {
+	if err := desired.applicable(); err != nil {
+		return ApplyResult{}, err
+	}
+	result := ApplyResult{Created: []string{}, Updated: []string{}, Deleted: []string{}}
+	err := cf.Execute(Operation{Op: OpApply, State: &desired, Prune: prune, applied: &result})
+	return result, err
+}
+
+// applyState merges desired into the configuration, validates the result
+// the way the control API validates every resource put and records the
+// changes into result if set.
+func (cf Configuration) applyState(desired *State, prune bool, result *ApplyResult) error {
+	if desired == nil {
+		return errors.New("No state to apply")
+	}
+	if err := desired.applicable(); err != nil {
+		return err
+	}
+	before, err := cf.State().Copy()
+	if err != nil {
+		return err
+	}
+	current, err := cf.State().Copy()
+	if err != nil {
+		return err
+	}
+	wanted, err := desired.Copy()
+	if err != nil {
+		return err
+	}
+	merged, err := merge(current, wanted, prune)
+	if err != nil {
+		return err
+	}
+	cf.Restore(merged)
+	for _, c := range cf.Clusters {
+		if err := cf.checkCluster(c); err != nil {
+			return err
+		}
+	}
+	for _, r := range cf.RouteConf {
+		if err := cf.checkRoute(r); err != nil {
+			return err
+		}
+	}
+	for _, l := range cf.Listeners {
+		if err := cf.checkGroups(l.Groups); err != nil {
+			return err
+		}
+	}
+	after, err := cf.State().Copy()
+	if err != nil {
+		return err
+	}
+	changes := diffState(before, after)
+	for _, deleted := range changes.Deleted {
+		var refs []string
+		if name := strings.TrimPrefix(deleted, "cluster/"); name != deleted {
+			refs = cf.ClusterRefs(name)
+		} else if name := strings.TrimPrefix(deleted, "route/"); name != deleted {
+			refs = cf.RouteRefs(name)
+		}
+		if len(refs) > 0 {
+			return fmt.Errorf("Pruned %s is %w by %s", deleted, ErrReferenced, strings.Join(refs, ", "))
+		}
+	}
+	if result != nil {
+		*result = changes
+	}
+	return nil
+}
+
+// applicable refuses the sections of a desired state apply does not manage,
+// rather than dropping them.
+func (s *State) applicable() error {
+	var sections []string
+	if len(s.Rollouts) > 0 {
+		sections = append(sections, "Rollouts")
+	}
+	if len(s.BlueGreens) > 0 {
+		sections = append(sections, "BlueGreens")
+	}
+	if len(s.Previews) > 0 {
+		sections = append(sections, "Previews")
+	}
+	if len(s.Secrets) > 0 {
+		sections = append(sections, "Secrets")
+	}
+	if len(sections) > 0 {
+		return fmt.Errorf("Apply only manages Clusters, RouteConf, Listeners and NodeGroups, not %s", strings.Join(sections, ", "))
+	}
+	return nil
+}
+
+// merge returns current with desired applied on top, both states are
+// consumed. The clusters of previews are never pruned.
+func merge(current, desired State, prune bool) (State, error) {
+	normalize(desired)
+
+	for name, c := range desired.Clusters {
+		if c.Endpoints == nil {
+			c.Endpoints = make(EndpointsMap)
+			if old, ok := current.Clusters[name]; ok {
+				c.Endpoints = old.Endpoints
+			}
+		}
+		current.Clusters[name] = c
+	}
+	for name, r := range desired.RouteConf {
+		old, ok := current.RouteConf[name]
+		if !ok {
+			old = &RouteConf{Mirroring: make(Mirrors)}
+		}
+		if r.Mirroring == nil {
+			r.Mirroring = old.Mirroring
+		}
+		if r.VirtualHosts == nil {
+			r.VirtualHosts = old.VirtualHosts
+		}
+		if err := keepDriven(current, old, r); err != nil {
+			return current, err
+		}
+		current.RouteConf[name] = r
+	}
+	for name, l := range desired.Listeners {
+		current.Listeners[name] = l
+	}
+	for name, g := range desired.NodeGroups {
+		current.NodeGroups[name] = g
+	}
+
+	if prune {
+		previews := make(map[string]bool)
+		for _, p := range current.Previews {
+			previews[p.resource()] = true
+		}
+		for name := range current.Clusters {
+			if _, ok := desired.Clusters[name]; !ok && !previews[name] {
+				delete(current.Clusters, name)
+			}
+		}
+		for name := range current.RouteConf {
+			if _, ok := desired.RouteConf[name]; !ok {
+				delete(current.RouteConf, name)
+			}
+		}
+		for name := range current.Listeners {
+			if _, ok := desired.Listeners[name]; !ok {
+				delete(current.Listeners, name)
+			}
+		}
+		for name := range current.NodeGroups {
+			if _, ok := desired.NodeGroups[name]; !ok {
+				delete(current.NodeGroups, name)
+			}
+		}
+	}
+
+	// listeners are enabled and assigned exactly when their route has
+	// something to serve
+	for _, r := range current.RouteConf {
+		r.Assigments = make(RouteAssigments)
+	}
+	for _, l := range current.Listeners {
+		if r, ok := current.RouteConf[l.Route]; ok && r.routable() {
+			l.State = StateEnabled
+			r.Assigments[l.Name] = true
+		} else {
+			l.State = StateDisabled
+		}
+	}
+	return current, nil
+}
+
+// keepDriven carries over to r what the rollouts, blue/green pairs and
+// previews of state drive in old: the default traffic and the preview rules.
+func keepDriven(state State, old, r *RouteConf) error {
+	for _, ro := range state.Rollouts {
+		if ro.Route == r.Name && ro.active() {
+			r.Cluster, r.Weights = old.Cluster, old.Weights
+		}
+	}
+	for _, bg := range state.BlueGreens {
+		if bg.Route == r.Name {
+			r.Cluster, r.Weights = old.Cluster, old.Weights
+		}
+	}
+	for _, p := range state.Previews {
+		if p.Route != r.Name {
+			continue
+		}
+		if p.VHost == "" {
+			r.Rules = append([]*RouteRule{p.rule()}, withoutRule(r.Rules, p.resource())...)
+			continue
+		}
+		vh, ok := r.VirtualHosts[p.VHost]
+		if !ok {
+			return fmt.Errorf("Virtual host %s of route %s is %w by preview/%s", p.VHost, r.Name, ErrReferenced, p.Name)
+		}
+		vh.Routes = append([]*RouteRule{p.rule()}, withoutRule(vh.Routes, p.resource())...)
+	}
+	return nil
+}
+
+// diffState lists the clusters, routes, listeners and node groups that
+// differ between before and after.
+func diffState(before, after State) ApplyResult {
+	result := ApplyResult{Created: []string{}, Updated: []string{}, Deleted: []string{}}
+	diffResources(&result, "cluster", before.Clusters, after.Clusters)
+	diffResources(&result, "route", before.RouteConf, after.RouteConf)
+	diffResources(&result, "listener", before.Listeners, after.Listeners)
+	diffResources(&result, "nodegroup", before.NodeGroups, after.NodeGroups)
+	sort.Strings(result.Created)
+	sort.Strings(result.Updated)
+	sort.Strings(result.Deleted)
+	return result
+}
+
+// diffResources adds the differences between two resource maps of kind to
+// result.
+func diffResources(result *ApplyResult, kind string, before, after interface{}) {
+	old, new := reflect.ValueOf(before), reflect.ValueOf(after)
+	for _, key := range new.MapKeys() {
+		name := kind + "/" + key.String()
+		if res := old.MapIndex(key); !res.IsValid() {
+			result.Created = append(result.Created, name)
+		} else if !reflect.DeepEqual(res.Interface(), new.MapIndex(key).Interface()) {
+			result.Updated = append(result.Updated, name)
+		}
+	}
+	for _, key := range old.MapKeys() {
+		if !new.MapIndex(key).IsValid() {
+			result.Deleted = append(result.Deleted, kind+"/"+key.String())
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const SideBlue = "blue"
+const SideGreen = "green"
+
+type BlueGreensMap map[string]*BlueGreen
+
+// BlueGreen sends all the default traffic of Route to the Blue or the Green
+// cluster, whichever side is Live. The other side is kept warm to flip back.
+type BlueGreen struct {
+	Name    string
+	Route   string
+	Blue    string
+	Green   string
+	Live    string
+	Flipped time.Time
+}
+
+// LiveCluster returns the cluster of the live side.
+func (bg *BlueGreen) LiveCluster() string {
+	if bg.Live == SideGreen {
+		return bg.Green
+	}
+	return bg.Blue
+}
+
+func otherSide(side string) string {
+	if side == SideGreen {
+		return SideBlue
+	}
+	return SideGreen
+}
+
+func (cf Configuration) PutBlueGreen(bg *BlueGreen) error {
+	return cf.Execute(Operation{Op: OpPutBlueGreen, Name: bg.Name, BlueGreen: bg})
+}
+
+func (cf Configuration) DeleteBlueGreen(name string) error {
+	return cf.Execute(Operation{Op: OpDeleteBlueGreen, Name: name})
+}
+
+// FlipBlueGreen makes side live, the other side if side is empty.
+func (cf Configuration) FlipBlueGreen(name, side string) error {
+	return cf.Execute(Operation{Op: OpFlipBlueGreen, Name: name, Side: side})
+}
+
+// putBlueGreen creates or replaces a blue/green pair and points its route at
+// the live side, blue unless Live says otherwise.
+func (cf Configuration) putBlueGreen(bg *BlueGreen) error {
+	if bg == nil || bg.Name == "" {
+		return errors.New("Blue/green name is required")
+	}
+	if bg.Route == "" || bg.Blue == "" || bg.Green == "" {
+		return errors.New("Blue/green needs a Route, a Blue and a Green cluster")
+	}
+	if bg.Blue == bg.Green {
+		return errors.New("Blue/green Blue and Green are the same cluster")
+	}
+	if bg.Live == "" {
+		bg.Live = SideBlue
+	}
+	if bg.Live != SideBlue && bg.Live != SideGreen {
+		return fmt.Errorf("Blue/green Live must be %s or %s", SideBlue, SideGreen)
+	}
+	if !cf.RouteOk(bg.Route) {
+		return fmt.Errorf("Route %s %w", bg.Route, ErrNotFound)
+	}
+	for _, c := range []string{bg.Blue, bg.Green} {
+		if _, ok := cf.Clusters[c]; !ok {
+			return fmt.Errorf("Cluster %s %w", c, ErrNotFound)
+		}
+	}
+	for _, other := range cf.BlueGreens {
+		if other.Name != bg.Name && other.Route == bg.Route {
+			return fmt.Errorf("Route %s is already switched by %s", bg.Route, other.Name)
+		}
+	}
+	if err := cf.routeRolledOut(bg.Route); err != nil {
+		return err
+	}
+	bg.Flipped = time.Now()
+	cf.BlueGreens[bg.Name] = bg
+	return cf.setRouteCluster(bg.Route, bg.LiveCluster())
+}
+
+func (cf Configuration) deleteBlueGreen(name string) error {
+	if _, ok := cf.BlueGreens[name]; !ok {
+		return fmt.Errorf("Blue/green %s %w", name, ErrNotFound)
+	}
+	delete(cf.BlueGreens, name)
+	return nil
+}
+
+func (cf Configuration) flipBlueGreen(name, side string) error {
+	bg, ok := cf.BlueGreens[name]
+	if !ok {
+		return fmt.Errorf("Blue/green %s %w", name, ErrNotFound)
+	}
+	switch side {
+	case "":
+		side = otherSide(bg.Live)
+	case SideBlue, SideGreen:
+	default:
+		return fmt.Errorf("Blue/green side must be %s or %s", SideBlue, SideGreen)
+	}
+	if err := cf.routeRolledOut(bg.Route); err != nil {
+		return err
+	}
+	bg.Live = side
+	bg.Flipped = time.Now()
+	return cf.setRouteCluster(bg.Route, bg.LiveCluster())
+}
+
+// routeRolledOut refuses to switch a route an active rollout is stepping.
+func (cf Configuration) routeRolledOut(route string) error {
+	for _, ro := range cf.Rollouts {
+		if ro.Route == route && ro.active() {
+			return fmt.Errorf("Route %s is being rolled out by %s", route, ro.Name)
+		}
+	}
+	return nil
+}
+
+// setRouteCluster sends all the default traffic of route to cluster.
+func (cf Configuration) setRouteCluster(route, cluster string) error {
+	r, ok := cf.RouteConf[route]
+	if !ok {
+		return fmt.Errorf("Route %s %w", route, ErrNotFound)
+	}
+	r.Cluster = cluster
+	r.Weights = nil
+	return r.checkDomains()
+}
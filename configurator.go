@@ -1,11 +1,15 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"sort"
 	"strconv"
-	"time"
+	"strings"
+	"sync"
+	"sync/atomic"
 
-	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 )
@@ -13,18 +17,57 @@ import (
 const StateEnabled = "enabled"
 const StateDisabled = "disabled"
 
+var ErrNotFound = errors.New("not found")
+var ErrReferenced = errors.New("still used")
+
 type ClustersMap map[string]*Cluster
 type RouteConfMap map[string]*RouteConf
 type ListenersMap map[string]*Listener
 type EndpointsMap map[string]*Endpoint
 type RouteAssigments map[string]bool
-type Mirrors map[string]uint32
+type Mirrors map[string]*Mirror
+type ClusterWeights map[string]uint32
 type VirtualHosts map[string]*VHost
 
+// VHost serves the requests for its domains with its own route rules,
+// the first matching rule wins.
 type VHost struct {
 	Name    string
 	Domains []string
-	Routes  []route.Route
+	Routes  []*RouteRule
+}
+
+// RouteRule sends the requests matching all its matchers to Cluster, or
+// splits them across the clusters of Weights. The path is matched by one of
+// Path, Prefix or Regex, any path by default.
+type RouteRule struct {
+	Name    string
+	Path    string
+	Prefix  string
+	Regex   string
+	Method  string
+	Headers []HeaderMatch
+	Query   []QueryMatch
+	Cluster string
+	Weights ClusterWeights
+}
+
+// HeaderMatch matches a request header by its exact value, by a regex or
+// by its presence alone.
+type HeaderMatch struct {
+	Name    string
+	Exact   string
+	Regex   string
+	Present bool
+	Invert  bool
+}
+
+// QueryMatch matches a query parameter like HeaderMatch matches a header.
+type QueryMatch struct {
+	Name    string
+	Exact   string
+	Regex   string
+	Present bool
 }
 
 type Listener struct {
@@ -33,13 +76,26 @@ type Listener struct {
 	Port    uint32
 	Route   string
 	State   string
+	Groups  []string
 }
 
+// RouteConf sends the requests matching one of Rules to its cluster and
+// everything else to Cluster or across Weights, unless a virtual host
+// matches the requested domain first. Timeout, IdleTimeout, Retry and
+// HashPolicies apply to all of them, Envoy defaults are used when unset.
 type RouteConf struct {
-	Name       string
-	Assigments RouteAssigments
-	Mirroring  Mirrors
-	Cluster    string
+	Name         string
+	Assigments   RouteAssigments
+	Mirroring    Mirrors
+	Cluster      string
+	Weights      ClusterWeights
+	Rules        []*RouteRule
+	VirtualHosts VirtualHosts
+	Timeout      string
+	IdleTimeout  string
+	Retry        *RetryPolicy
+	HashPolicies []HashPolicy
+	Groups       []string
 }
 
 type Endpoint struct {
@@ -48,36 +104,460 @@ type Endpoint struct {
 	State        string
 }
 
+// Cluster balances the requests across its Endpoints with LbPolicy, tuned
+// by RingHash or Maglev for the hashing policies. Endpoints failing one of
+// HealthChecks get no requests until they pass again, the ones failing
+// requests are ejected by OutlierDetection. Protocol is http1 (default),
+// http2 or auto, connections are closed after MaxRequestsPerConnection
+// requests or IdleTimeout without any, the connect timeout is 5s unless
+// ConnectTimeout says otherwise. Endpoints are reached over TLS if set.
 type Cluster struct {
-	Name      string
-	Endpoints EndpointsMap
+	Name                     string
+	Endpoints                EndpointsMap
+	LbPolicy                 string
+	RingHash                 *RingHash
+	Maglev                   *Maglev
+	HealthChecks             []*HealthCheck
+	OutlierDetection         *OutlierDetection
+	CircuitBreakers          CircuitBreakers
+	Protocol                 string
+	ConnectTimeout           string
+	PerConnectionBufferLimit uint32
+	MaxRequestsPerConnection uint32
+	IdleTimeout              string
+	TLS                      *UpstreamTLS
+	Groups                   []string
 }
 
 type Configuration struct {
 	Clusters      ClustersMap
 	RouteConf     RouteConfMap
 	Listeners     ListenersMap
-	SnapshotCache *cache.SnapshotCache
+	NodeGroups    NodeGroupsMap
+	Rollouts      RolloutsMap
+	BlueGreens    BlueGreensMap
+	Previews      PreviewsMap
+	Secrets       SecretsMap
+	SnapshotCache *cache.SnapshotCache `json:"-"`
+	Store         Store                `json:"-"`
+	OpLog         *OpLog               `json:"-"`
+	History       *History             `json:"-"`
+	Generation    *Generation          `json:"-"`
+	Hash          *GroupHash           `json:"-"`
+
+	mu   *sync.RWMutex
+	plan *Plan
+}
+
+// Generation is the monotonic snapshot version counter.
+type Generation struct {
+	n uint64
+}
+
+func (g *Generation) Next() uint64 {
+	return atomic.AddUint64(&g.n, 1)
+}
+
+func (g *Generation) Current() uint64 {
+	return atomic.LoadUint64(&g.n)
+}
+
+// Resume continues counting after a persisted version. The version right
+// after it may have been served without being persisted, so it is skipped
+// along with one version per replayed operation.
+func (g *Generation) Resume(version uint64, replayed int) {
+	atomic.StoreUint64(&g.n, version+uint64(replayed)+1)
+}
+
+// Version returns the version of the last generated snapshot.
+func (cf Configuration) Version() string {
+	return strconv.FormatUint(cf.Generation.Current(), 10)
+}
+
+func (cf Configuration) State() State {
+	state := State{
+		Clusters:   cf.Clusters,
+		RouteConf:  cf.RouteConf,
+		Listeners:  cf.Listeners,
+		NodeGroups: cf.NodeGroups,
+		Rollouts:   cf.Rollouts,
+		BlueGreens: cf.BlueGreens,
+		Previews:   cf.Previews,
+		Secrets:    cf.Secrets,
+	}
+	if cf.OpLog != nil {
+		state.Seq = cf.OpLog.Seq()
+	}
+	state.Version = cf.Generation.Current()
+	return state
+}
+
+// Restore replaces the configuration content with state.
+func (cf Configuration) Restore(state State) {
+	for k := range cf.Clusters {
+		delete(cf.Clusters, k)
+	}
+	for k, v := range state.Clusters {
+		cf.Clusters[k] = v
+	}
+	for k := range cf.RouteConf {
+		delete(cf.RouteConf, k)
+	}
+	for k, v := range state.RouteConf {
+		cf.RouteConf[k] = v
+	}
+	for k := range cf.Listeners {
+		delete(cf.Listeners, k)
+	}
+	for k, v := range state.Listeners {
+		cf.Listeners[k] = v
+	}
+	for k := range cf.NodeGroups {
+		delete(cf.NodeGroups, k)
+	}
+	for k, v := range state.NodeGroups {
+		cf.NodeGroups[k] = v
+	}
+	for k := range cf.Rollouts {
+		delete(cf.Rollouts, k)
+	}
+	for k, v := range state.Rollouts {
+		cf.Rollouts[k] = v
+	}
+	for k := range cf.BlueGreens {
+		delete(cf.BlueGreens, k)
+	}
+	for k, v := range state.BlueGreens {
+		cf.BlueGreens[k] = v
+	}
+	for k := range cf.Previews {
+		delete(cf.Previews, k)
+	}
+	for k, v := range state.Previews {
+		cf.Previews[k] = v
+	}
+	for k := range cf.Secrets {
+		delete(cf.Secrets, k)
+	}
+	for k, v := range state.Secrets {
+		cf.Secrets[k] = v
+	}
 }
 
 func (cf Configuration) AddCluster(name string) error {
+	return cf.Execute(Operation{Op: OpAddCluster, Name: name})
+}
+
+func (cf Configuration) AddEndpoint(name, cluster, address string, port uint32) error {
+	return cf.Execute(Operation{Op: OpAddEndpoint, Name: name, Cluster: cluster, Address: address, Port: port})
+}
+
+func (cf Configuration) DeleteEndpoint(name, cluster string) error {
+	return cf.Execute(Operation{Op: OpDeleteEndpoint, Name: name, Cluster: cluster})
+}
+
+func (cf Configuration) DisableEndpoint(name, cluster string) error {
+	return cf.Execute(Operation{Op: OpDisableEndpoint, Name: name, Cluster: cluster})
+}
+
+func (cf Configuration) EnableEndpoint(name, cluster string) error {
+	return cf.Execute(Operation{Op: OpEnableEndpoint, Name: name, Cluster: cluster})
+}
+
+func (cf Configuration) AddRoute(name, cluster string) error {
+	return cf.Execute(Operation{Op: OpAddRoute, Name: name, Cluster: cluster})
+}
+
+func (cf Configuration) AddListener(name, address string, port uint32, route string) error {
+	return cf.Execute(Operation{Op: OpAddListener, Name: name, Address: address, Port: port, Route: route})
+}
+
+func (cf Configuration) AddMirroring(route, cluster string, m *Mirror) error {
+	return cf.Execute(Operation{Op: OpAddMirroring, Route: route, Cluster: cluster, Mirror: m})
+}
+
+func (cf Configuration) PutCluster(c *Cluster) error {
+	return cf.Execute(Operation{Op: OpPutCluster, Name: c.Name, ClusterConf: c})
+}
+
+func (cf Configuration) PatchCluster(name string, patch json.RawMessage) error {
+	return cf.Execute(Operation{Op: OpPatchCluster, Name: name, Patch: patch})
+}
+
+func (cf Configuration) DeleteCluster(name string, cascade bool) error {
+	return cf.Execute(Operation{Op: OpDeleteCluster, Name: name, Cascade: cascade})
+}
+
+func (cf Configuration) PutRoute(r *RouteConf) error {
+	return cf.Execute(Operation{Op: OpPutRoute, Name: r.Name, RouteConf: r})
+}
+
+func (cf Configuration) PatchRoute(name string, patch json.RawMessage) error {
+	return cf.Execute(Operation{Op: OpPatchRoute, Name: name, Patch: patch})
+}
+
+func (cf Configuration) DeleteRoute(name string, cascade bool) error {
+	return cf.Execute(Operation{Op: OpDeleteRoute, Name: name, Cascade: cascade})
+}
+
+func (cf Configuration) PutListener(l *Listener) error {
+	return cf.Execute(Operation{Op: OpPutListener, Name: l.Name, ListenerConf: l})
+}
+
+func (cf Configuration) PatchListener(name string, patch json.RawMessage) error {
+	return cf.Execute(Operation{Op: OpPatchListener, Name: name, Patch: patch})
+}
+
+func (cf Configuration) DeleteListener(name string) error {
+	return cf.Execute(Operation{Op: OpDeleteListener, Name: name})
+}
+
+func (cf Configuration) DeleteMirroring(route, cluster string) error {
+	return cf.Execute(Operation{Op: OpDeleteMirroring, Route: route, Cluster: cluster})
+}
+
+// Rollback restores the configuration that produced snapshot version.
+func (cf Configuration) Rollback(version string) error {
+	if cf.History == nil {
+		return errors.New("Snapshot history is disabled")
+	}
+	rev, ok := cf.History.Get(version)
+	if !ok {
+		return errors.New("Snapshot not found")
+	}
+	return cf.Execute(Operation{Op: OpRestore, State: rev.State})
+}
+
+// Batch applies ops atomically and publishes a single snapshot.
+func (cf Configuration) Batch(ops []Operation) error {
+	return cf.Execute(Operation{Op: OpBatch, Ops: ops})
+}
+
+// Execute applies op, logs it and publishes the result. The configuration
+// is left untouched if op fails or the result is not consistent.
+func (cf Configuration) Execute(op Operation) error {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	if cf.plan != nil {
+		return cf.dryRun(op)
+	}
+	backup, err := cf.State().Copy()
+	if err != nil {
+		return err
+	}
+	if err := cf.apply(op); err != nil {
+		cf.Restore(backup)
+		return err
+	}
+	if op.applied != nil && op.applied.Empty() {
+		return nil
+	}
+	if cf.OpLog != nil {
+		if err := cf.OpLog.Append(&op); err != nil {
+			Log.Errorf("oplog error: %s", err)
+			cf.Restore(backup)
+			return err
+		}
+	}
+	if err := cf.GenerateSnapshot(); err != nil {
+		cf.Restore(backup)
+		return err
+	}
+	if err := cf.persist(); err != nil {
+		return err
+	}
+	if cf.OpLog != nil && cf.OpLog.NeedsCompaction() {
+		if err := cf.OpLog.Compact(cf.State()); err != nil {
+			Log.Errorf("oplog compaction error: %s", err)
+		}
+	}
+	return nil
+}
+
+// dryRun applies op, records how the served snapshot would change and
+// restores the configuration.
+func (cf Configuration) dryRun(op Operation) error {
+	backup, err := cf.State().Copy()
+	if err != nil {
+		return err
+	}
+	defer cf.Restore(backup)
+
+	if err := cf.apply(op); err != nil {
+		return err
+	}
+	snapshots, err := cf.makeSnapshots("dry-run")
+	if err != nil {
+		return err
+	}
+	groups := make(map[string]bool)
+	for group := range snapshots {
+		groups[group] = true
+	}
+	for group := range cf.NodeGroups {
+		groups[group] = true
+	}
+	for _, group := range backup.groupNames() {
+		groups[group] = true
+	}
+	names := make([]string, 0, len(groups))
+	for group := range groups {
+		names = append(names, group)
+	}
+	sort.Strings(names)
+	for _, group := range names {
+		// nothing served yet compares against an empty snapshot
+		current, _ := (*cf.SnapshotCache).GetSnapshot(group)
+		changes, err := diffSnapshots(current, snapshots[group])
+		if err != nil {
+			return err
+		}
+		for i := range changes {
+			changes[i].Group = group
+		}
+		cf.plan.Changes = append(cf.plan.Changes, changes...)
+	}
+	return nil
+}
+
+// replay applies a logged op the same way Execute did, without publishing it.
+func (cf Configuration) replay(op Operation) error {
+	backup, err := cf.State().Copy()
+	if err != nil {
+		return err
+	}
+	if err = cf.apply(op); err == nil {
+		_, err = cf.makeSnapshots("")
+	}
+	if err != nil {
+		cf.Restore(backup)
+	}
+	return err
+}
+
+// apply changes the configuration maps without publishing them.
+func (cf Configuration) apply(op Operation) error {
+	switch op.Op {
+	case OpBatch:
+		for i, sub := range op.Ops {
+			if sub.Op == OpBatch {
+				return fmt.Errorf("operation %d: batches can not be nested", i)
+			}
+			if err := cf.apply(sub); err != nil {
+				return fmt.Errorf("operation %d (%s): %s", i, sub.Op, err)
+			}
+		}
+		return nil
+	case OpAddCluster:
+		return cf.addCluster(op.Name)
+	case OpAddEndpoint:
+		return cf.addEndpoint(op.Name, op.Cluster, op.Address, op.Port)
+	case OpDeleteEndpoint:
+		return cf.deleteEndpoint(op.Name, op.Cluster)
+	case OpDisableEndpoint:
+		return cf.setEndpointState(op.Name, op.Cluster, StateDisabled)
+	case OpEnableEndpoint:
+		return cf.setEndpointState(op.Name, op.Cluster, StateEnabled)
+	case OpAddRoute:
+		return cf.addRoute(op.Name, op.Cluster)
+	case OpAddListener:
+		return cf.addListener(op.Name, op.Address, op.Port, op.Route)
+	case OpAddMirroring:
+		m := op.Mirror
+		if m == nil {
+			// logged before mirrors had a denominator
+			m = &Mirror{Numerator: op.Fraction}
+		}
+		return cf.addMirroring(op.Route, op.Cluster, m)
+	case OpPatchMirroring:
+		return cf.patchMirroring(op.Route, op.Cluster, op.Patch)
+	case OpPutCluster:
+		return cf.putCluster(op.ClusterConf)
+	case OpPatchCluster:
+		return cf.patchCluster(op.Name, op.Patch)
+	case OpDeleteCluster:
+		return cf.deleteCluster(op.Name, op.Cascade)
+	case OpPutRoute:
+		return cf.putRoute(op.RouteConf)
+	case OpPatchRoute:
+		return cf.patchRoute(op.Name, op.Patch)
+	case OpDeleteRoute:
+		return cf.deleteRoute(op.Name, op.Cascade)
+	case OpPutListener:
+		return cf.putListener(op.ListenerConf)
+	case OpPatchListener:
+		return cf.patchListener(op.Name, op.Patch)
+	case OpDeleteListener:
+		return cf.deleteListener(op.Name)
+	case OpDeleteMirroring:
+		return cf.deleteMirroring(op.Route, op.Cluster)
+	case OpPutPreview:
+		return cf.putPreview(op.Preview)
+	case OpDeletePreview:
+		return cf.deletePreview(op.Name)
+	case OpPutSecret:
+		return cf.putSecret(op.Secret)
+	case OpDeleteSecret:
+		return cf.deleteSecret(op.Name)
+	case OpPutVHost:
+		return cf.putVHost(op.Route, op.VHost)
+	case OpDeleteVHost:
+		return cf.deleteVHost(op.Route, op.Name)
+	case OpAddRouteRule:
+		return cf.addRouteRule(op.Route, op.Name, op.Rule)
+	case OpDeleteRouteRule:
+		return cf.deleteRouteRule(op.Route, op.Name, op.Rule)
+	case OpSetWeights:
+		return cf.setWeights(op.Route, op.Name, op.Rule, op.Weights)
+	case OpPutRollout:
+		return cf.putRollout(op.Rollout)
+	case OpDeleteRollout:
+		return cf.deleteRollout(op.Name)
+	case OpStepRollout:
+		return cf.stepRollout(op.Name, op.Step, op.At)
+	case OpPauseRollout:
+		return cf.pauseRollout(op.Name)
+	case OpResumeRollout:
+		return cf.resumeRollout(op.Name, op.At)
+	case OpAbortRollout:
+		return cf.abortRollout(op.Name, op.Reason)
+	case OpPutBlueGreen:
+		return cf.putBlueGreen(op.BlueGreen)
+	case OpFlipBlueGreen:
+		return cf.flipBlueGreen(op.Name, op.Side)
+	case OpDeleteBlueGreen:
+		return cf.deleteBlueGreen(op.Name)
+	case OpPutNodeGroup:
+		return cf.putNodeGroup(op.NodeGroup)
+	case OpDeleteNodeGroup:
+		return cf.deleteNodeGroup(op.Name)
+	case OpRestore:
+		return cf.restore(op.State)
+	case OpApply:
+		return cf.applyState(op.State, op.Prune, op.applied)
+	default:
+		return fmt.Errorf("unknown operation %q", op.Op)
+	}
+}
+
+func (cf Configuration) addCluster(name string) error {
 	if _, ok := cf.Clusters[name]; ok {
 		return errors.New("Cluster already exists")
 	} else {
-		cf.Clusters[name] = &Cluster{name, make(EndpointsMap)}
+		cf.Clusters[name] = &Cluster{Name: name, Endpoints: make(EndpointsMap)}
 		return nil
 	}
 }
 
-func (cf Configuration) AddEndpoint(name, cluster, address string, port uint32) error {
+func (cf Configuration) addEndpoint(name, cluster, address string, port uint32) error {
 	if _, ok := cf.Clusters[cluster]; ok {
 		cf.Clusters[cluster].Endpoints[name] = &Endpoint{address, port, StateEnabled}
 	} else {
-		_ = cf.AddCluster(cluster)
+		_ = cf.addCluster(cluster)
 		cf.Clusters[cluster].Endpoints[name] = &Endpoint{address, port, StateEnabled}
 	}
-	err := cf.GenerateSnapshot()
-	return err
+	return nil
 }
 
 func (cf Configuration) CheckEndpoint(name, cluster string) error {
@@ -92,40 +572,27 @@ func (cf Configuration) CheckEndpoint(name, cluster string) error {
 	}
 }
 
-func (cf Configuration) DeleteEndpoint(name, cluster string) error {
+func (cf Configuration) deleteEndpoint(name, cluster string) error {
 	err := cf.CheckEndpoint(name, cluster)
 	if err != nil {
 		return err
 	} else {
 		delete(cf.Clusters[cluster].Endpoints, name)
-		err := cf.GenerateSnapshot()
-		return err
-	}
-}
-
-func (cf Configuration) DisableEndpoint(name, cluster string) error {
-	err := cf.CheckEndpoint(name, cluster)
-	if err != nil {
-		return err
-	} else {
-		cf.Clusters[cluster].Endpoints[name].State = StateDisabled
-		err := cf.GenerateSnapshot()
-		return err
+		return nil
 	}
 }
 
-func (cf Configuration) EnableEndpoint(name, cluster string) error {
+func (cf Configuration) setEndpointState(name, cluster, state string) error {
 	err := cf.CheckEndpoint(name, cluster)
 	if err != nil {
 		return err
 	} else {
-		cf.Clusters[cluster].Endpoints[name].State = StateEnabled
-		err := cf.GenerateSnapshot()
-		return err
+		cf.Clusters[cluster].Endpoints[name].State = state
+		return nil
 	}
 }
 
-func (cf Configuration) AddRoute(name, cluster string) error {
+func (cf Configuration) addRoute(name, cluster string) error {
 	if _, ok := cf.RouteConf[name]; ok {
 		return errors.New("Route already exists")
 	} else {
@@ -136,8 +603,7 @@ func (cf Configuration) AddRoute(name, cluster string) error {
 			Mirroring:  make(Mirrors),
 		}
 		cf.ListenerCheck(name)
-		err := cf.GenerateSnapshot()
-		return err
+		return nil
 	}
 }
 
@@ -154,62 +620,534 @@ func (cf Configuration) RouteAssign(route, listener string) error {
 	return nil
 }
 
-func (cf Configuration) AddListener(name, address string, port uint32, route string) error {
+func (cf Configuration) addListener(name, address string, port uint32, route string) error {
 	if _, ok := cf.Listeners[name]; ok {
 		return errors.New("Listener already exists")
 	} else {
 		if cf.RouteOk(route) {
-			cf.Listeners[name] = &Listener{name, address, port, route, StateEnabled}
+			cf.Listeners[name] = &Listener{Name: name, Address: address, Port: port, Route: route, State: StateEnabled}
 			_ = cf.RouteAssign(route, name)
 		} else {
-			cf.Listeners[name] = &Listener{name, address, port, route, StateDisabled}
+			cf.Listeners[name] = &Listener{Name: name, Address: address, Port: port, Route: route, State: StateDisabled}
 		}
-		err := cf.GenerateSnapshot()
-		return err
+		return nil
 	}
 }
 
+// ListenerCheck enables the disabled listeners of route once it has
+// something to serve.
 func (cf Configuration) ListenerCheck(route string) {
+	r, ok := cf.RouteConf[route]
+	if !ok || !r.routable() {
+		return
+	}
 	for _, l := range cf.Listeners {
-		if l.State == StateDisabled {
-			if _, ok := cf.RouteConf[l.Route]; ok {
-				l.State = StateEnabled
-				cf.RouteConf[route].Assigments[l.Name] = true
+		if l.State == StateDisabled && l.Route == route {
+			l.State = StateEnabled
+			r.Assigments[l.Name] = true
+		}
+	}
+}
+
+// unassign disables the listeners of a route left with nothing to serve,
+// ListenerCheck enables them again.
+func (cf Configuration) unassign(r *RouteConf) {
+	for name := range r.Assigments {
+		if l, ok := cf.Listeners[name]; ok {
+			l.State = StateDisabled
+		}
+		delete(r.Assigments, name)
+	}
+}
+
+func (cf Configuration) deleteMirroring(route, cluster string) error {
+	if !cf.RouteOk(route) {
+		return fmt.Errorf("Route %s %w", route, ErrNotFound)
+	}
+	if _, ok := cf.RouteConf[route].Mirroring[cluster]; !ok {
+		return fmt.Errorf("Mirror %s %w", cluster, ErrNotFound)
+	}
+	delete(cf.RouteConf[route].Mirroring, cluster)
+	return nil
+}
+
+// putCluster creates or replaces a cluster, the endpoints are kept unless
+// c lists them.
+func (cf Configuration) putCluster(c *Cluster) error {
+	if c == nil || c.Name == "" {
+		return errors.New("Cluster name is required")
+	}
+	if c.Endpoints == nil {
+		if old, ok := cf.Clusters[c.Name]; ok {
+			c.Endpoints = old.Endpoints
+		} else {
+			c.Endpoints = make(EndpointsMap)
+		}
+	}
+	if err := cf.checkCluster(c); err != nil {
+		return err
+	}
+	cf.Clusters[c.Name] = c
+	return nil
+}
+
+// checkCluster validates a cluster against the rest of the configuration,
+// filling in its defaults.
+func (cf Configuration) checkCluster(c *Cluster) error {
+	if err := cf.checkGroups(c.Groups); err != nil {
+		return err
+	}
+	if err := c.checkLb(); err != nil {
+		return err
+	}
+	if err := c.checkProtocol(); err != nil {
+		return err
+	}
+	if err := c.checkHealthChecks(); err != nil {
+		return err
+	}
+	if err := c.checkResilience(); err != nil {
+		return err
+	}
+	return cf.checkTLS(c)
+}
+
+func (cf Configuration) patchCluster(name string, patch json.RawMessage) error {
+	old, ok := cf.Clusters[name]
+	if !ok {
+		return fmt.Errorf("Cluster %s %w", name, ErrNotFound)
+	}
+	c := &Cluster{}
+	if err := patchCopy(old, patch, c); err != nil {
+		return err
+	}
+	c.Name = name
+	return cf.putCluster(c)
+}
+
+// ClusterRefs lists the routes, mirrors, active rollouts, blue/green pairs
+// and previews using cluster.
+func (cf Configuration) ClusterRefs(cluster string) []string {
+	var refs []string
+	for _, r := range cf.RouteConf {
+		if r.Cluster == cluster || r.Weights.has(cluster) {
+			refs = append(refs, "route/"+r.Name)
+		}
+		if _, ok := r.Mirroring[cluster]; ok {
+			refs = append(refs, "mirror/"+r.Name)
+		}
+		for _, rule := range r.Rules {
+			if rule.uses(cluster) {
+				refs = append(refs, "rule/"+r.Name+"/"+rule.Name)
+			}
+		}
+		for _, vh := range r.VirtualHosts {
+			for _, rule := range vh.Routes {
+				if rule.uses(cluster) {
+					refs = append(refs, "rule/"+r.Name+"/"+vh.Name+"/"+rule.Name)
+				}
 			}
 		}
 	}
+	for _, ro := range cf.Rollouts {
+		if ro.active() && (ro.Stable == cluster || ro.Canary == cluster) {
+			refs = append(refs, "rollout/"+ro.Name)
+		}
+	}
+	for _, bg := range cf.BlueGreens {
+		if bg.Blue == cluster || bg.Green == cluster {
+			refs = append(refs, "bluegreen/"+bg.Name)
+		}
+	}
+	for _, p := range cf.Previews {
+		if p.resource() == cluster {
+			refs = append(refs, "preview/"+p.Name)
+		}
+	}
+	sort.Strings(refs)
+	return refs
 }
 
-func (cf Configuration) AddMirroring(route, cluster string, fraction uint32) error {
-	cf.RouteConf[route].Mirroring[cluster] = fraction
-	err := cf.GenerateSnapshot()
-	return err
+// RouteRefs lists the active rollouts, blue/green pairs and previews
+// driving route.
+func (cf Configuration) RouteRefs(route string) []string {
+	var refs []string
+	for _, ro := range cf.Rollouts {
+		if ro.Route == route && ro.active() {
+			refs = append(refs, "rollout/"+ro.Name)
+		}
+	}
+	for _, bg := range cf.BlueGreens {
+		if bg.Route == route {
+			refs = append(refs, "bluegreen/"+bg.Name)
+		}
+	}
+	for _, p := range cf.Previews {
+		if p.Route == route {
+			refs = append(refs, "preview/"+p.Name)
+		}
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+// deleteCluster refuses to delete a cluster in use, unless cascade is set:
+// then the mirrors, route rules, blue/green pairs and previews using it are
+// deleted as well and the rollouts using it are aborted. Rules and routes
+// splitting traffic only lose their share for it, routes sending it their
+// default traffic lose their default. The listeners of a route left with
+// nothing to serve are disabled, not deleted.
+func (cf Configuration) deleteCluster(name string, cascade bool) error {
+	if _, ok := cf.Clusters[name]; !ok {
+		return fmt.Errorf("Cluster %s %w", name, ErrNotFound)
+	}
+	if refs := cf.ClusterRefs(name); len(refs) > 0 {
+		if !cascade {
+			return fmt.Errorf("Cluster %s is %w by %s", name, ErrReferenced, strings.Join(refs, ", "))
+		}
+		for _, r := range cf.RouteConf {
+			delete(r.Mirroring, name)
+			r.Rules = withoutCluster(r.Rules, name)
+			for _, vh := range r.VirtualHosts {
+				vh.Routes = withoutCluster(vh.Routes, name)
+			}
+			if r.Cluster == name {
+				r.Cluster = ""
+			}
+			if !r.Weights.without(name) {
+				r.Weights = nil
+			}
+			if !r.routable() {
+				cf.unassign(r)
+			}
+		}
+		for _, ro := range cf.Rollouts {
+			if ro.active() && (ro.Stable == name || ro.Canary == name) {
+				ro.State = RolloutAborted
+				ro.Message = fmt.Sprintf("Cluster %s deleted", name)
+			}
+		}
+		for _, bg := range cf.BlueGreens {
+			if bg.Blue == name || bg.Green == name {
+				delete(cf.BlueGreens, bg.Name)
+			}
+		}
+		for _, p := range cf.Previews {
+			if p.resource() == name {
+				delete(cf.Previews, p.Name)
+			}
+		}
+	}
+	delete(cf.Clusters, name)
+	return nil
+}
+
+// putRoute creates or replaces a route, the mirrors and virtual hosts are
+// kept unless r lists them.
+func (cf Configuration) putRoute(r *RouteConf) error {
+	if r == nil || r.Name == "" {
+		return errors.New("Route name is required")
+	}
+	if old, ok := cf.RouteConf[r.Name]; ok {
+		r.Assigments = old.Assigments
+		if r.Mirroring == nil {
+			r.Mirroring = old.Mirroring
+		}
+		if r.VirtualHosts == nil {
+			r.VirtualHosts = old.VirtualHosts
+		}
+	} else {
+		r.Assigments = make(RouteAssigments)
+		if r.Mirroring == nil {
+			r.Mirroring = make(Mirrors)
+		}
+	}
+	if err := cf.checkRoute(r); err != nil {
+		return err
+	}
+	cf.RouteConf[r.Name] = r
+	cf.ListenerCheck(r.Name)
+	return nil
+}
+
+// checkRoute validates a route against the rest of the configuration.
+func (cf Configuration) checkRoute(r *RouteConf) error {
+	if err := cf.checkGroups(r.Groups); err != nil {
+		return err
+	}
+	if r.Cluster != "" && len(r.Weights) > 0 {
+		return fmt.Errorf("Route %s can only have one of Cluster and Weights", r.Name)
+	}
+	if err := checkWeights(r.Weights); err != nil {
+		return fmt.Errorf("Route %s %s", r.Name, err)
+	}
+	if err := cf.checkTargets(r.Cluster, r.Weights); err != nil {
+		return err
+	}
+	if err := checkRules("Route "+r.Name, r.Rules); err != nil {
+		return err
+	}
+	if err := cf.checkRuleTargets(r.Rules); err != nil {
+		return err
+	}
+	if err := r.checkPolicies(); err != nil {
+		return err
+	}
+	for name, vh := range r.VirtualHosts {
+		if vh == nil {
+			return fmt.Errorf("Virtual host %s is empty", name)
+		}
+		vh.Name = name
+		if err := vh.check(); err != nil {
+			return err
+		}
+		if err := cf.checkRuleTargets(vh.Routes); err != nil {
+			return err
+		}
+	}
+	if err := r.checkDomains(); err != nil {
+		return err
+	}
+	for cluster, m := range r.Mirroring {
+		if err := cf.checkMirror(cluster, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cf Configuration) patchRoute(name string, patch json.RawMessage) error {
+	old, ok := cf.RouteConf[name]
+	if !ok {
+		return fmt.Errorf("Route %s %w", name, ErrNotFound)
+	}
+	r := &RouteConf{}
+	if err := patchCopy(old, patch, r); err != nil {
+		return err
+	}
+	r.Name = name
+	return cf.putRoute(r)
+}
+
+// deleteRoute refuses to delete a route in use, unless cascade is set: then
+// the listeners using it are deleted as well. A route driven by an active
+// rollout, a blue/green pair or a preview is never deleted.
+func (cf Configuration) deleteRoute(name string, cascade bool) error {
+	if _, ok := cf.RouteConf[name]; !ok {
+		return fmt.Errorf("Route %s %w", name, ErrNotFound)
+	}
+	if refs := cf.RouteRefs(name); len(refs) > 0 {
+		return fmt.Errorf("Route %s is %w by %s", name, ErrReferenced, strings.Join(refs, ", "))
+	}
+	var refs []string
+	for _, l := range cf.Listeners {
+		if l.Route == name {
+			refs = append(refs, "listener/"+l.Name)
+		}
+	}
+	if len(refs) > 0 {
+		if !cascade {
+			sort.Strings(refs)
+			return fmt.Errorf("Route %s is %w by %s", name, ErrReferenced, strings.Join(refs, ", "))
+		}
+		for _, l := range cf.Listeners {
+			if l.Route == name {
+				delete(cf.Listeners, l.Name)
+			}
+		}
+	}
+	delete(cf.RouteConf, name)
+	return nil
+}
+
+// putListener creates or replaces a listener, it is enabled once its route
+// exists.
+func (cf Configuration) putListener(l *Listener) error {
+	if l == nil || l.Name == "" {
+		return errors.New("Listener name is required")
+	}
+	if err := cf.checkGroups(l.Groups); err != nil {
+		return err
+	}
+	if old, ok := cf.Listeners[l.Name]; ok && cf.RouteOk(old.Route) {
+		delete(cf.RouteConf[old.Route].Assigments, l.Name)
+	}
+	if cf.RouteOk(l.Route) {
+		l.State = StateEnabled
+		_ = cf.RouteAssign(l.Route, l.Name)
+	} else {
+		l.State = StateDisabled
+	}
+	cf.Listeners[l.Name] = l
+	return nil
+}
+
+func (cf Configuration) patchListener(name string, patch json.RawMessage) error {
+	old, ok := cf.Listeners[name]
+	if !ok {
+		return fmt.Errorf("Listener %s %w", name, ErrNotFound)
+	}
+	l := &Listener{}
+	if err := patchCopy(old, patch, l); err != nil {
+		return err
+	}
+	l.Name = name
+	return cf.putListener(l)
+}
+
+func (cf Configuration) deleteListener(name string) error {
+	l, ok := cf.Listeners[name]
+	if !ok {
+		return fmt.Errorf("Listener %s %w", name, ErrNotFound)
+	}
+	if cf.RouteOk(l.Route) {
+		delete(cf.RouteConf[l.Route].Assigments, name)
+	}
+	delete(cf.Listeners, name)
+	return nil
+}
+
+// patchCopy decodes a copy of old with patch applied on top into out.
+func patchCopy(old interface{}, patch json.RawMessage, out interface{}) error {
+	data, err := json.Marshal(old)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, out); err != nil {
+		return err
+	}
+	return json.Unmarshal(patch, out)
+}
+
+func (cf Configuration) restore(state *State) error {
+	if state == nil {
+		return errors.New("No state to restore")
+	}
+	// the state may be shared with the history, never hand it out
+	copied, err := state.Copy()
+	if err != nil {
+		return err
+	}
+	cf.Restore(copied)
+	return nil
+}
+
+func (cf Configuration) addMirroring(route, cluster string, m *Mirror) error {
+	if !cf.RouteOk(route) {
+		return fmt.Errorf("Route %s %w", route, ErrNotFound)
+	}
+	if err := cf.checkMirror(cluster, m); err != nil {
+		return err
+	}
+	cf.RouteConf[route].Mirroring[cluster] = m
+	return nil
+}
+
+func (cf Configuration) persist() error {
+	if cf.Store == nil {
+		return nil
+	}
+	if err := cf.Store.Save(cf.State()); err != nil {
+		Log.Errorf("store error: %s", err)
+		return err
+	}
+	return nil
 }
 
 func (cf Configuration) GenerateSnapshot() error {
-	var endpoints, clusters, routes, listeners []types.Resource
+	version := strconv.FormatUint(cf.Generation.Next(), 10)
+	snapshots, err := cf.makeSnapshots(version)
+	if err != nil {
+		return err
+	}
+
+	if cf.Hash != nil {
+		cf.Hash.Update(cf.NodeGroups)
+	}
+	scache := *cf.SnapshotCache
+	for group, snapshot := range snapshots {
+		if err := scache.SetSnapshot(group, snapshot); err != nil {
+			// never log the snapshot itself, it holds the private keys of secrets
+			Log.Errorf("snapshot error %q for group %s version %s", err, group, version)
+			return err
+		}
+	}
+	// nodes still watching a deleted group get the default snapshot, their
+	// next request is hashed to the group they belong to now
+	for _, key := range scache.GetStatusKeys() {
+		if _, ok := snapshots[key]; !ok {
+			if err := scache.SetSnapshot(key, snapshots[nodeID]); err != nil {
+				Log.Errorf("snapshot error %q for stale group %s", err, key)
+			}
+		}
+	}
+	if cf.History != nil {
+		cf.History.Record(version, snapshots, cf.State())
+	}
+	return nil
+}
+
+// makeSnapshots renders a consistent snapshot for every node group.
+func (cf Configuration) makeSnapshots(version string) (map[string]cache.Snapshot, error) {
+	snapshots := make(map[string]cache.Snapshot)
+	for _, group := range cf.Groups() {
+		snapshot, err := cf.makeSnapshot(snapshotVersion(version, group), group)
+		if err != nil {
+			if group != nodeID {
+				err = fmt.Errorf("node group %s: %w", group, err)
+			}
+			return nil, err
+		}
+		snapshots[group] = snapshot
+	}
+	return snapshots, nil
+}
+
+// assigned reports whether a listener of group uses route r.
+func (cf Configuration) assigned(r *RouteConf, group string) bool {
+	for name := range r.Assigments {
+		if l, ok := cf.Listeners[name]; ok && l.State == StateEnabled && inGroup(l.Groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// makeSnapshot renders the resources of group into a consistent snapshot.
+func (cf Configuration) makeSnapshot(version, group string) (cache.Snapshot, error) {
+	var endpoints, clusters, routes, listeners, secrets []types.Resource
+	served := make(map[string]bool)
 	for _, elem := range cf.Clusters {
-		clusters = append(clusters, makeCluster(elem.Name))
-		endpoints = append(endpoints, makeEndpoint(elem))
+		if inGroup(elem.Groups, group) {
+			clusters = append(clusters, makeCluster(elem))
+			endpoints = append(endpoints, makeEndpoint(elem))
+			for _, name := range elem.TLS.names() {
+				if s, ok := cf.Secrets[name]; ok && !served[name] {
+					served[name] = true
+					secrets = append(secrets, makeSecret(s))
+				}
+			}
+		}
 	}
 
 	for _, elem := range cf.RouteConf {
-		if len(elem.Assigments) > 0 && len(elem.Cluster) > 0 {
-			r := makeRoute(elem.Name, elem.Cluster)
-			if len(elem.Mirroring) > 0 {
-				var m []*route.RouteAction_RequestMirrorPolicy
-				for mirror, fraction := range elem.Mirroring {
-					m = makeMirroringConfig(mirror, fraction)
-				}
-				r.VirtualHosts[0].Routes[0].GetRoute().RequestMirrorPolicies = m
+		if !inGroup(elem.Groups, group) {
+			continue
+		}
+		if cf.assigned(elem, group) && elem.routable() {
+			if err := elem.checkDomains(); err != nil {
+				return cache.Snapshot{}, err
 			}
-			routes = append(routes, r)
+			routes = append(routes, makeRoute(elem))
 		} else {
 			Log.Infof("route %s has 0 assigments, skipping", elem.Name)
 		}
 	}
 
 	for _, elem := range cf.Listeners {
+		if !inGroup(elem.Groups, group) {
+			continue
+		}
 		if elem.State == StateEnabled {
 			listeners = append(listeners, makeHTTPListener(elem))
 		} else {
@@ -217,27 +1155,23 @@ func (cf Configuration) GenerateSnapshot() error {
 		}
 	}
 
-	cache_id := time.Now().Unix()
 	snapshot := cache.NewSnapshot(
-		strconv.FormatInt(cache_id, 16),
+		version,
 		endpoints,
 		clusters,
 		routes,
 		listeners,
 		[]types.Resource{}, // runtimes
-		[]types.Resource{}, // secrets
+		secrets,
 	)
 
 	if err := snapshot.Consistent(); err != nil {
-		Log.Errorf("snapshot inconsistency: %+v\n%+v", snapshot, err)
-		return err
+		Log.Errorf("snapshot inconsistency in version %s: %s", version, err)
+		return snapshot, err
 	}
-
-	scache := *cf.SnapshotCache
-	if err := scache.SetSnapshot(nodeID, snapshot); err != nil {
-		Log.Errorf("snapshot error %q for %+v", err, snapshot)
-		return err
-	} else {
-		return nil
+	if err := validateSnapshot(snapshot); err != nil {
+		Log.Errorf("snapshot validation: %s", err)
+		return snapshot, err
 	}
+	return snapshot, nil
 }
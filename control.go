@@ -1,65 +1,165 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+const VersionHeader = "X-Snapshot-Version"
+
+const planKey = "plan"
+
+const waitKey = "wait"
+
+const defaultWaitTimeout = 30 * time.Second
+
+// WaitOptions reads ?wait=ack&timeout=30s, which makes a mutation reply only
+// once every connected node ACKed the published version.
+func WaitOptions(c *gin.Context) {
+	switch c.Query("wait") {
+	case "":
+		return
+	case "ack":
+	default:
+		replyError(c, http.StatusBadRequest, fmt.Errorf("Unknown wait mode %q", c.Query("wait")))
+		c.Abort()
+		return
+	}
+	timeout := defaultWaitTimeout
+	if t := c.Query("timeout"); t != "" {
+		var err error
+		if timeout, err = time.ParseDuration(t); err != nil || timeout <= 0 {
+			replyError(c, http.StatusBadRequest, fmt.Errorf("Invalid timeout %q", t))
+			c.Abort()
+			return
+		}
+	}
+	c.Set(waitKey, timeout)
+}
+
+// config returns the configuration a request works on, with ?dryRun=true
+// it is a copy that only plans the changes.
+func config(c *gin.Context) Configuration {
+	if c.Query("dryRun") != "true" {
+		return CF
+	}
+	cf, plan := CF.DryRun()
+	c.Set(planKey, plan)
+	return cf
+}
+
+// reply sends msg together with the current snapshot version and the
+// planned changes of a dry run. With ?wait=ack it first waits for the nodes
+// to ACK the version, and lists the nodes lagging behind if they do not.
+func reply(c *gin.Context, code int, msg interface{}) {
+	version := CF.Version()
+	c.Header(VersionHeader, version)
+	body := gin.H{"message": msg, "version": version}
+	if plan, ok := c.Get(planKey); ok {
+		body["dryRun"] = true
+		body["changes"] = plan.(*Plan).Changes
+	} else if timeout, ok := c.Get(waitKey); ok {
+		generation, _ := versionGeneration(version)
+		lagging, rejected := FleetStatus.WaitAcked(generation, timeout.(time.Duration))
+		body["acked"] = len(lagging) == 0
+		if len(lagging) > 0 {
+			body["lagging"] = lagging
+			code = http.StatusGatewayTimeout
+			if rejected {
+				code = http.StatusBadGateway
+			}
+		}
+	}
+	c.JSON(code, body)
+}
+
+// replyLegacy answers the endpoints predating the snapshot versions with
+// the bare message their clients expect, the version is only sent in the
+// header. Dry runs and ?wait=ack, which they never had, get a full reply.
+func replyLegacy(c *gin.Context, code int, msg string) {
+	_, planned := c.Get(planKey)
+	_, waiting := c.Get(waitKey)
+	if planned || waiting {
+		reply(c, code, msg)
+		return
+	}
+	c.Header(VersionHeader, CF.Version())
+	c.JSON(code, msg)
+}
+
+func replyError(c *gin.Context, code int, err error) {
+	version := CF.Version()
+	c.Header(VersionHeader, version)
+	body := gin.H{"error": err.Error(), "version": version}
+	if _, ok := c.Get(planKey); ok {
+		body["dryRun"] = true
+	}
+	c.JSON(code, body)
+}
+
 func CInfo(c *gin.Context) {
-	c.JSON(http.StatusOK, CF)
+	CF.mu.RLock()
+	defer CF.mu.RUnlock()
+	info := CF
+	info.Secrets = CF.Secrets.redacted()
+	c.Header(VersionHeader, CF.Version())
+	c.JSON(http.StatusOK, info)
 }
 
 func AddListener(c *gin.Context) {
 	var data ListenerRequest
 	c.BindJSON(&data)
-	err := CF.AddListener(data.Name, data.Address, data.Port, data.Route)
+	err := config(c).AddListener(data.Name, data.Address, data.Port, data.Route)
 	if err != nil {
-		c.JSON(http.StatusOK, err)
+		replyError(c, http.StatusOK, err)
 	} else {
-		c.JSON(http.StatusCreated, "Listener created")
+		replyLegacy(c, http.StatusCreated, "Listener created")
 	}
 }
 
 func AddCluster(c *gin.Context) {
 	var data ClusterRequest
 	c.BindJSON(&data)
-	if err := CF.AddCluster(data.Name); err != nil {
-		c.JSON(http.StatusAlreadyReported, err)
+	if err := config(c).AddCluster(data.Name); err != nil {
+		replyError(c, http.StatusAlreadyReported, err)
 	} else {
-		c.JSON(http.StatusCreated, "Cluster created")
+		replyLegacy(c, http.StatusCreated, "Cluster created")
 	}
 }
 
 func AddRoute(c *gin.Context) {
 	var data RouteRequest
 	c.BindJSON(&data)
-	if err := CF.AddRoute(data.Name, data.ClusterName); err != nil {
-		c.JSON(http.StatusAlreadyReported, err)
+	if err := config(c).AddRoute(data.Name, data.ClusterName); err != nil {
+		replyError(c, http.StatusAlreadyReported, err)
 	} else {
-		c.JSON(http.StatusCreated, "Route created")
+		replyLegacy(c, http.StatusCreated, "Route created")
 	}
 }
 
 func AddEndpoint(c *gin.Context) {
 	var data EndpointRequest
-	err := c.BindJSON(&data)
-	fmt.Println(err)
-	if err := CF.AddEndpoint(data.Name, data.ClusterName, data.Address, data.Port); err == nil {
-		c.JSON(http.StatusCreated, "Endpoint added")
+	if err := c.ShouldBindJSON(&data); err != nil {
+		replyError(c, http.StatusBadRequest, err)
+	} else if err := config(c).AddEndpoint(data.Name, data.ClusterName, data.Address, data.Port); err == nil {
+		replyLegacy(c, http.StatusCreated, "Endpoint added")
 	} else {
-		c.JSON(http.StatusFailedDependency, err)
+		replyError(c, http.StatusFailedDependency, err)
 	}
 }
 
 func DeleteEndpoint(c *gin.Context) {
 	var data EndpointRequest
-	c.BindJSON(&data)
-	if err := CF.DeleteEndpoint(data.Name, data.ClusterName); err == nil {
-		c.JSON(http.StatusCreated, "Endpoint deleted")
+	if err := c.ShouldBindJSON(&data); err != nil {
+		replyError(c, http.StatusBadRequest, err)
+	} else if err := config(c).DeleteEndpoint(data.Name, data.ClusterName); err == nil {
+		replyLegacy(c, http.StatusCreated, "Endpoint deleted")
 	} else {
-		c.JSON(http.StatusFailedDependency, err)
+		replyError(c, http.StatusFailedDependency, err)
 	}
 }
 
@@ -68,39 +168,529 @@ func SwitchEndpoint(c *gin.Context) {
 	c.BindJSON(&data)
 	switch data.Switch {
 	case "off":
-		err := CF.DisableEndpoint(data.Name, data.ClusterName)
+		err := config(c).DisableEndpoint(data.Name, data.ClusterName)
 		if err != nil {
-			c.JSON(http.StatusOK, err)
+			replyError(c, http.StatusOK, err)
 		} else {
-			c.JSON(http.StatusOK, "Endpoint disabled")
+			replyLegacy(c, http.StatusOK, "Endpoint disabled")
 		}
 	case "on":
-		err := CF.EnableEndpoint(data.Name, data.ClusterName)
+		err := config(c).EnableEndpoint(data.Name, data.ClusterName)
 		if err != nil {
-			c.JSON(http.StatusOK, err)
+			replyError(c, http.StatusOK, err)
 		} else {
-			c.JSON(http.StatusOK, "Endpoint enabled")
+			replyLegacy(c, http.StatusOK, "Endpoint enabled")
 		}
 	default:
-		c.JSON(http.StatusOK, "action not supported, use on/off")
+		replyLegacy(c, http.StatusOK, "action not supported, use on/off")
 	}
 }
 
 func AddMirroring(c *gin.Context) {
 	var data MirrorRequest
 	c.BindJSON(&data)
-	err := CF.AddMirroring(data.Route, data.Cluster, data.Fraction)
+	err := config(c).AddMirroring(data.Route, data.Cluster, data.mirror())
+	if err != nil {
+		replyError(c, http.StatusOK, err)
+	} else {
+		replyLegacy(c, http.StatusOK, "mirroring enabled")
+	}
+}
+
+func Batch(c *gin.Context) {
+	var data BatchRequest
+	if err := c.ShouldBindJSON(&data); err != nil {
+		replyError(c, http.StatusBadRequest, err)
+	} else if err := config(c).Batch(data.Operations); err != nil {
+		replyError(c, http.StatusFailedDependency, err)
+	} else {
+		reply(c, http.StatusOK, fmt.Sprintf("%d operations applied", len(data.Operations)))
+	}
+}
+
+func Apply(c *gin.Context) {
+	data, err := c.GetRawData()
+	if err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+	desired, err := ParseState(data)
 	if err != nil {
-		c.JSON(http.StatusOK, err)
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+	result, err := config(c).Apply(desired, c.Query("prune") == "true")
+	if err != nil {
+		replyError(c, errorStatus(err), err)
 	} else {
-		c.JSON(http.StatusOK, "mirroring enabled")
+		reply(c, http.StatusOK, result)
 	}
 }
 
+// errorStatus maps configuration errors to HTTP statuses.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrReferenced):
+		return http.StatusConflict
+	default:
+		return http.StatusFailedDependency
+	}
+}
+
+// view replies with the resource found by get under the read lock.
+func view(c *gin.Context, get func() (interface{}, bool)) {
+	CF.mu.RLock()
+	defer CF.mu.RUnlock()
+	c.Header(VersionHeader, CF.Version())
+	if res, ok := get(); ok {
+		c.JSON(http.StatusOK, res)
+	} else {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found", "version": CF.Version()})
+	}
+}
+
+// mutate replies with msg when fn succeeds.
+func mutate(c *gin.Context, msg string, fn func(cf Configuration) error) {
+	if err := fn(config(c)); err != nil {
+		replyError(c, errorStatus(err), err)
+	} else {
+		reply(c, http.StatusOK, msg)
+	}
+}
+
+func ListClusters(c *gin.Context) {
+	view(c, func() (interface{}, bool) { return CF.Clusters, true })
+}
+
+func GetCluster(c *gin.Context) {
+	view(c, func() (interface{}, bool) {
+		res, ok := CF.Clusters[c.Param("name")]
+		return res, ok
+	})
+}
+
+func PutCluster(c *gin.Context) {
+	var data Cluster
+	if err := c.ShouldBindJSON(&data); err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+	data.Name = c.Param("name")
+	mutate(c, "Cluster saved", func(cf Configuration) error { return cf.PutCluster(&data) })
+}
+
+func PatchCluster(c *gin.Context) {
+	patch, err := c.GetRawData()
+	if err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+	mutate(c, "Cluster updated", func(cf Configuration) error { return cf.PatchCluster(c.Param("name"), patch) })
+}
+
+func DeleteCluster(c *gin.Context) {
+	mutate(c, "Cluster deleted", func(cf Configuration) error {
+		return cf.DeleteCluster(c.Param("name"), c.Query("cascade") == "true")
+	})
+}
+
+func ListRoutes(c *gin.Context) {
+	view(c, func() (interface{}, bool) { return CF.RouteConf, true })
+}
+
+func GetRoute(c *gin.Context) {
+	view(c, func() (interface{}, bool) {
+		res, ok := CF.RouteConf[c.Param("name")]
+		return res, ok
+	})
+}
+
+func PutRoute(c *gin.Context) {
+	var data RouteConf
+	if err := c.ShouldBindJSON(&data); err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+	data.Name = c.Param("name")
+	mutate(c, "Route saved", func(cf Configuration) error { return cf.PutRoute(&data) })
+}
+
+func PatchRoute(c *gin.Context) {
+	patch, err := c.GetRawData()
+	if err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+	mutate(c, "Route updated", func(cf Configuration) error { return cf.PatchRoute(c.Param("name"), patch) })
+}
+
+func DeleteRoute(c *gin.Context) {
+	mutate(c, "Route deleted", func(cf Configuration) error {
+		return cf.DeleteRoute(c.Param("name"), c.Query("cascade") == "true")
+	})
+}
+
+func ListListeners(c *gin.Context) {
+	view(c, func() (interface{}, bool) { return CF.Listeners, true })
+}
+
+func GetListener(c *gin.Context) {
+	view(c, func() (interface{}, bool) {
+		res, ok := CF.Listeners[c.Param("name")]
+		return res, ok
+	})
+}
+
+func PutListener(c *gin.Context) {
+	var data Listener
+	if err := c.ShouldBindJSON(&data); err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+	data.Name = c.Param("name")
+	mutate(c, "Listener saved", func(cf Configuration) error { return cf.PutListener(&data) })
+}
+
+func PatchListener(c *gin.Context) {
+	patch, err := c.GetRawData()
+	if err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+	mutate(c, "Listener updated", func(cf Configuration) error { return cf.PatchListener(c.Param("name"), patch) })
+}
+
+func DeleteListener(c *gin.Context) {
+	mutate(c, "Listener deleted", func(cf Configuration) error { return cf.DeleteListener(c.Param("name")) })
+}
+
+func ListMirrors(c *gin.Context) {
+	view(c, func() (interface{}, bool) {
+		if r, ok := CF.RouteConf[c.Param("name")]; ok {
+			return r.Mirroring, true
+		}
+		return nil, false
+	})
+}
+
+func GetMirror(c *gin.Context) {
+	view(c, func() (interface{}, bool) {
+		if r, ok := CF.RouteConf[c.Param("name")]; ok {
+			res, ok := r.Mirroring[c.Param("cluster")]
+			return res, ok
+		}
+		return nil, false
+	})
+}
+
+func PutMirror(c *gin.Context) {
+	var data MirrorRequest
+	if err := c.ShouldBindJSON(&data); err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+	mutate(c, "Mirror saved", func(cf Configuration) error {
+		return cf.AddMirroring(c.Param("name"), c.Param("cluster"), data.mirror())
+	})
+}
+
+func PatchMirror(c *gin.Context) {
+	patch, err := c.GetRawData()
+	if err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+	mutate(c, "Mirror updated", func(cf Configuration) error {
+		return cf.PatchMirroring(c.Param("name"), c.Param("cluster"), patch)
+	})
+}
+
+func DeleteMirror(c *gin.Context) {
+	mutate(c, "Mirror deleted", func(cf Configuration) error {
+		return cf.DeleteMirroring(c.Param("name"), c.Param("cluster"))
+	})
+}
+
+func ListVHosts(c *gin.Context) {
+	view(c, func() (interface{}, bool) {
+		if r, ok := CF.RouteConf[c.Param("name")]; ok {
+			if r.VirtualHosts == nil {
+				return VirtualHosts{}, true
+			}
+			return r.VirtualHosts, true
+		}
+		return nil, false
+	})
+}
+
+func GetVHost(c *gin.Context) {
+	view(c, func() (interface{}, bool) {
+		if r, ok := CF.RouteConf[c.Param("name")]; ok {
+			res, ok := r.VirtualHosts[c.Param("vhost")]
+			return res, ok
+		}
+		return nil, false
+	})
+}
+
+func PutVHost(c *gin.Context) {
+	var data VHost
+	if err := c.ShouldBindJSON(&data); err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+	data.Name = c.Param("vhost")
+	mutate(c, "Virtual host saved", func(cf Configuration) error { return cf.PutVHost(c.Param("name"), &data) })
+}
+
+func DeleteVHost(c *gin.Context) {
+	mutate(c, "Virtual host deleted", func(cf Configuration) error {
+		return cf.DeleteVHost(c.Param("name"), c.Param("vhost"))
+	})
+}
+
+func AddRouteRule(c *gin.Context) {
+	var data RouteRule
+	if err := c.ShouldBindJSON(&data); err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+	mutate(c, "Rule added", func(cf Configuration) error {
+		return cf.AddRouteRule(c.Param("name"), c.Param("vhost"), &data)
+	})
+}
+
+func DeleteRouteRule(c *gin.Context) {
+	mutate(c, "Rule deleted", func(cf Configuration) error {
+		return cf.DeleteRouteRule(c.Param("name"), c.Param("vhost"), c.Param("rule"))
+	})
+}
+
+// SetWeights splits the traffic of the route, or of one of its rules, with
+// a body like {"stable": 90, "canary": 10}.
+func SetWeights(c *gin.Context) {
+	var data ClusterWeights
+	if err := c.ShouldBindJSON(&data); err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+	mutate(c, "Weights saved", func(cf Configuration) error {
+		return cf.SetWeights(c.Param("name"), c.Param("vhost"), c.Param("rule"), data)
+	})
+}
+
+func ListRollouts(c *gin.Context) {
+	view(c, func() (interface{}, bool) { return CF.Rollouts, true })
+}
+
+func GetRollout(c *gin.Context) {
+	view(c, func() (interface{}, bool) {
+		res, ok := CF.Rollouts[c.Param("name")]
+		return res, ok
+	})
+}
+
+func PutRollout(c *gin.Context) {
+	var data Rollout
+	if err := c.ShouldBindJSON(&data); err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+	data.Name = c.Param("name")
+	mutate(c, "Rollout started", func(cf Configuration) error { return cf.PutRollout(&data) })
+}
+
+func DeleteRollout(c *gin.Context) {
+	mutate(c, "Rollout deleted", func(cf Configuration) error { return cf.DeleteRollout(c.Param("name")) })
+}
+
+func PauseRollout(c *gin.Context) {
+	mutate(c, "Rollout paused", func(cf Configuration) error { return cf.PauseRollout(c.Param("name")) })
+}
+
+func ResumeRollout(c *gin.Context) {
+	mutate(c, "Rollout resumed", func(cf Configuration) error { return cf.ResumeRollout(c.Param("name")) })
+}
+
+func AbortRollout(c *gin.Context) {
+	mutate(c, "Rollout aborted", func(cf Configuration) error {
+		return cf.AbortRollout(c.Param("name"), "aborted by request")
+	})
+}
+
+func ListBlueGreens(c *gin.Context) {
+	view(c, func() (interface{}, bool) { return CF.BlueGreens, true })
+}
+
+func GetBlueGreen(c *gin.Context) {
+	view(c, func() (interface{}, bool) {
+		res, ok := CF.BlueGreens[c.Param("name")]
+		return res, ok
+	})
+}
+
+func PutBlueGreen(c *gin.Context) {
+	var data BlueGreen
+	if err := c.ShouldBindJSON(&data); err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+	data.Name = c.Param("name")
+	mutate(c, "Blue/green saved", func(cf Configuration) error { return cf.PutBlueGreen(&data) })
+}
+
+func DeleteBlueGreen(c *gin.Context) {
+	mutate(c, "Blue/green deleted", func(cf Configuration) error { return cf.DeleteBlueGreen(c.Param("name")) })
+}
+
+// FlipBlueGreen makes the other side live, or the side given by ?to=blue|green.
+func FlipBlueGreen(c *gin.Context) {
+	mutate(c, "Blue/green flipped", func(cf Configuration) error {
+		return cf.FlipBlueGreen(c.Param("name"), c.Query("to"))
+	})
+}
+
+func ListPreviews(c *gin.Context) {
+	view(c, func() (interface{}, bool) { return CF.Previews, true })
+}
+
+func GetPreview(c *gin.Context) {
+	view(c, func() (interface{}, bool) {
+		res, ok := CF.Previews[c.Param("name")]
+		return res, ok
+	})
+}
+
+// PutPreview creates the cluster, endpoints and rule of a preview in one
+// go, putting it again restarts its TTL.
+func PutPreview(c *gin.Context) {
+	var data Preview
+	if err := c.ShouldBindJSON(&data); err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+	data.Name = c.Param("name")
+	mutate(c, "Preview saved", func(cf Configuration) error { return cf.PutPreview(&data) })
+}
+
+func DeletePreview(c *gin.Context) {
+	mutate(c, "Preview deleted", func(cf Configuration) error { return cf.DeletePreview(c.Param("name")) })
+}
+
+// ListSecrets and GetSecret never hand out private keys.
+func ListSecrets(c *gin.Context) {
+	view(c, func() (interface{}, bool) { return CF.Secrets.redacted(), true })
+}
+
+func GetSecret(c *gin.Context) {
+	view(c, func() (interface{}, bool) {
+		if res, ok := CF.Secrets[c.Param("name")]; ok {
+			return res.redacted(), true
+		}
+		return nil, false
+	})
+}
+
+func PutSecret(c *gin.Context) {
+	var data Secret
+	if err := c.ShouldBindJSON(&data); err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+	data.Name = c.Param("name")
+	mutate(c, "Secret saved", func(cf Configuration) error { return cf.PutSecret(&data) })
+}
+
+func DeleteSecret(c *gin.Context) {
+	mutate(c, "Secret deleted", func(cf Configuration) error { return cf.DeleteSecret(c.Param("name")) })
+}
+
+func ListNodeGroups(c *gin.Context) {
+	view(c, func() (interface{}, bool) { return CF.NodeGroups, true })
+}
+
+func GetNodeGroup(c *gin.Context) {
+	view(c, func() (interface{}, bool) {
+		res, ok := CF.NodeGroups[c.Param("name")]
+		return res, ok
+	})
+}
+
+func PutNodeGroup(c *gin.Context) {
+	var data NodeGroup
+	if err := c.ShouldBindJSON(&data); err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+	data.Name = c.Param("name")
+	mutate(c, "Node group saved", func(cf Configuration) error { return cf.PutNodeGroup(&data) })
+}
+
+func DeleteNodeGroup(c *gin.Context) {
+	mutate(c, "Node group deleted", func(cf Configuration) error { return cf.DeleteNodeGroup(c.Param("name")) })
+}
+
+func ListNodes(c *gin.Context) {
+	c.Header(VersionHeader, CF.Version())
+	c.JSON(http.StatusOK, FleetStatus.Nodes())
+}
+
+func ListSnapshots(c *gin.Context) {
+	c.Header(VersionHeader, CF.Version())
+	if CF.History == nil {
+		c.JSON(http.StatusOK, []Revision{})
+	} else {
+		c.JSON(http.StatusOK, CF.History.List())
+	}
+}
+
+func GetSnapshot(c *gin.Context) {
+	if CF.History == nil {
+		replyError(c, http.StatusNotFound, errors.New("Snapshot history is disabled"))
+	} else if rev, ok := CF.History.Get(c.Param("version")); ok {
+		if rev.State != nil {
+			state := *rev.State
+			state.Secrets = state.Secrets.redacted()
+			rev.State = &state
+		}
+		c.Header(VersionHeader, CF.Version())
+		c.JSON(http.StatusOK, rev)
+	} else {
+		replyError(c, http.StatusNotFound, errors.New("Snapshot not found"))
+	}
+}
+
+func RollbackSnapshot(c *gin.Context) {
+	if err := config(c).Rollback(c.Param("version")); err != nil {
+		replyError(c, http.StatusFailedDependency, err)
+	} else {
+		reply(c, http.StatusOK, "Snapshot rolled back")
+	}
+}
+
+type BatchRequest struct {
+	Operations []Operation `json:"operations" binding:"required"`
+}
+
+// MirrorRequest takes the share as numerator out of denominator, fraction
+// is the percentage older clients send.
 type MirrorRequest struct {
-	Route    string `json:"route"`
-	Cluster  string `json:"cluster"`
-	Fraction uint32 `json:"fraction"`
+	Route       string `json:"route"`
+	Cluster     string `json:"cluster"`
+	Fraction    uint32 `json:"fraction"`
+	Numerator   uint32 `json:"numerator"`
+	Denominator string `json:"denominator"`
+	RuntimeKey  string `json:"runtimeKey"`
+}
+
+func (r MirrorRequest) mirror() *Mirror {
+	m := &Mirror{Numerator: r.Numerator, Denominator: r.Denominator, RuntimeKey: r.RuntimeKey}
+	if m.Numerator == 0 && m.Denominator == "" {
+		m.Numerator = r.Fraction
+	}
+	return m
 }
 
 type EndpointRequest struct {
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+)
+
+// NodeStatus is what is known about the Envoy node on one xDS stream.
+type NodeStatus struct {
+	Stream         int64
+	Delta          bool
+	ID             string
+	Cluster        string
+	Group          string
+	Locality       *Locality `json:",omitempty"`
+	UserAgent      string    `json:",omitempty"`
+	BuildVersion   string    `json:",omitempty"`
+	ConnectedSince time.Time
+	Resources      map[string]*ResourceStatus
+
+	node *core.Node
+}
+
+type Locality struct {
+	Region  string
+	Zone    string
+	SubZone string
+}
+
+// ResourceStatus follows the versions of one resource type on a stream.
+// A request answering the last sent nonce ACKs the sent version, or NACKs
+// it if it carries an error detail.
+type ResourceStatus struct {
+	LastRequest   time.Time
+	SentVersion   string
+	AckedVersion  string
+	NackedVersion string
+	NackError     string     `json:",omitempty"`
+	NackedAt      *time.Time `json:",omitempty"`
+
+	sentNonce string
+}
+
+// Fleet tracks the Envoy nodes connected to the xDS server, it implements
+// the xDS server callbacks.
+type Fleet struct {
+	mu      sync.RWMutex
+	hash    *GroupHash
+	streams map[int64]*NodeStatus
+	onNack  func(Nack)
+	// changed is closed and replaced whenever a node ACKs, NACKs or leaves
+	changed chan struct{}
+}
+
+// NewFleet returns a Fleet calling onNack, if set, for every rejected version.
+func NewFleet(hash *GroupHash, onNack func(Nack)) *Fleet {
+	return &Fleet{
+		hash:    hash,
+		streams: make(map[int64]*NodeStatus),
+		onNack:  onNack,
+		changed: make(chan struct{}),
+	}
+}
+
+// Lag is a resource type a node has not ACKed the awaited version of.
+type Lag struct {
+	Node          string
+	Group         string
+	Type          string
+	AckedVersion  string
+	NackedVersion string `json:",omitempty"`
+	NackError     string `json:",omitempty"`
+}
+
+// WaitAcked blocks until every connected node ACKed generation, or a newer
+// one, for each resource type it requested. It gives up when a node rejects
+// the generation or after timeout, and returns what is still lagging then.
+func (f *Fleet) WaitAcked(generation uint64, timeout time.Duration) (lagging []Lag, rejected bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		f.mu.RLock()
+		lagging, rejected = f.lagging(generation)
+		changed := f.changed
+		f.mu.RUnlock()
+		if len(lagging) == 0 || rejected {
+			return lagging, rejected
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return lagging, false
+		}
+	}
+}
+
+// lagging lists the resource types not ACKed at generation. f.mu must be held.
+func (f *Fleet) lagging(generation uint64) (lagging []Lag, rejected bool) {
+	for _, s := range f.streams {
+		if s.node == nil {
+			continue
+		}
+		for typeURL, r := range s.Resources {
+			if acked, err := versionGeneration(r.AckedVersion); err == nil && acked >= generation {
+				continue
+			}
+			lag := Lag{Node: s.ID, Group: f.hash.ID(s.node), Type: typeURL, AckedVersion: r.AckedVersion}
+			if nacked, err := versionGeneration(r.NackedVersion); err == nil && nacked >= generation {
+				lag.NackedVersion = r.NackedVersion
+				lag.NackError = r.NackError
+				rejected = true
+			}
+			lagging = append(lagging, lag)
+		}
+	}
+	sort.Slice(lagging, func(i, j int) bool {
+		if lagging[i].Node != lagging[j].Node {
+			return lagging[i].Node < lagging[j].Node
+		}
+		return lagging[i].Type < lagging[j].Type
+	})
+	return lagging, rejected
+}
+
+// notify wakes up WaitAcked. f.mu must be held.
+func (f *Fleet) notify() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// Nodes returns a copy of the status of every open stream, ordered by node ID.
+func (f *Fleet) Nodes() []NodeStatus {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	nodes := make([]NodeStatus, 0, len(f.streams))
+	for _, s := range f.streams {
+		status := *s
+		// the node groups may have changed since the node connected
+		status.Group = f.hash.ID(s.node)
+		status.Resources = make(map[string]*ResourceStatus, len(s.Resources))
+		for typeURL, r := range s.Resources {
+			res := *r
+			status.Resources[typeURL] = &res
+		}
+		nodes = append(nodes, status)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].ID != nodes[j].ID {
+			return nodes[i].ID < nodes[j].ID
+		}
+		return nodes[i].Stream < nodes[j].Stream
+	})
+	return nodes
+}
+
+func (f *Fleet) open(id int64, delta bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.streams[id] = &NodeStatus{
+		Stream:         id,
+		Delta:          delta,
+		ConnectedSince: time.Now(),
+		Resources:      make(map[string]*ResourceStatus),
+	}
+}
+
+func (f *Fleet) close(id int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.streams, id)
+	f.notify()
+}
+
+// request records a request of typeURL on stream id, version is the last
+// version the node accepted.
+func (f *Fleet) request(id int64, node *core.Node, typeURL, version, nonce string, detail error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.streams[id]
+	if !ok {
+		return
+	}
+	// the node is only sent on the first request of a stream
+	if node != nil && s.node == nil {
+		s.setNode(node)
+	}
+	r := s.resource(typeURL)
+	r.LastRequest = time.Now()
+	if nonce == "" || nonce != r.sentNonce {
+		// initial request or a response to a stale nonce
+		return
+	}
+	if detail != nil {
+		now := time.Now()
+		r.NackedVersion = r.SentVersion
+		r.NackError = detail.Error()
+		r.NackedAt = &now
+		Log.Warnf("node %s rejected %s version %s: %s", s.ID, typeURL, r.SentVersion, detail)
+		f.notify()
+		if f.onNack != nil {
+			group := f.hash.ID(s.node)
+			go f.onNack(Nack{
+				Node:      s.ID,
+				Group:     group,
+				Type:      typeURL,
+				Version:   r.SentVersion,
+				Error:     r.NackError,
+				At:        now,
+				LastAcked: f.lastAcked(group),
+			})
+		}
+		return
+	}
+	r.AckedVersion = version
+	f.notify()
+}
+
+func (f *Fleet) response(id int64, typeURL, version, nonce string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.streams[id]
+	if !ok {
+		return
+	}
+	r := s.resource(typeURL)
+	r.SentVersion = version
+	r.sentNonce = nonce
+}
+
+// lastAcked returns the oldest version ACKed by a node of group, which is the
+// newest version all of them ACKed. f.mu must be held.
+func (f *Fleet) lastAcked(group string) string {
+	var oldest string
+	var oldestGeneration uint64
+	for _, s := range f.streams {
+		if s.node == nil || f.hash.ID(s.node) != group {
+			continue
+		}
+		for _, r := range s.Resources {
+			generation, err := versionGeneration(r.AckedVersion)
+			if err != nil {
+				continue
+			}
+			if oldest == "" || generation < oldestGeneration {
+				oldest, oldestGeneration = r.AckedVersion, generation
+			}
+		}
+	}
+	return oldest
+}
+
+func (s *NodeStatus) resource(typeURL string) *ResourceStatus {
+	r, ok := s.Resources[typeURL]
+	if !ok {
+		r = &ResourceStatus{}
+		s.Resources[typeURL] = r
+	}
+	return r
+}
+
+func (s *NodeStatus) setNode(node *core.Node) {
+	s.node = node
+	s.ID = node.GetId()
+	s.Cluster = node.GetCluster()
+	if l := node.GetLocality(); l != nil {
+		s.Locality = &Locality{Region: l.GetRegion(), Zone: l.GetZone(), SubZone: l.GetSubZone()}
+	}
+	s.UserAgent = node.GetUserAgentName()
+	if v := node.GetUserAgentBuildVersion().GetVersion(); v != nil {
+		s.BuildVersion = fmt.Sprintf("%d.%d.%d", v.GetMajorNumber(), v.GetMinorNumber(), v.GetPatch())
+	} else if v := node.GetUserAgentVersion(); v != "" {
+		s.BuildVersion = v
+	}
+}
+
+func (f *Fleet) OnStreamOpen(_ context.Context, id int64, typ string) error {
+	Log.Debugf("stream %d open for %s", id, typ)
+	f.open(id, false)
+	return nil
+}
+
+func (f *Fleet) OnStreamClosed(id int64) {
+	Log.Debugf("stream %d closed", id)
+	f.close(id)
+}
+
+func (f *Fleet) OnStreamRequest(id int64, req *discovery.DiscoveryRequest) error {
+	var detail error
+	if req.GetErrorDetail() != nil {
+		detail = fmt.Errorf("%s", req.GetErrorDetail().GetMessage())
+	}
+	f.request(id, req.GetNode(), req.GetTypeUrl(), req.GetVersionInfo(), req.GetResponseNonce(), detail)
+	return nil
+}
+
+func (f *Fleet) OnStreamResponse(id int64, _ *discovery.DiscoveryRequest, resp *discovery.DiscoveryResponse) {
+	f.response(id, resp.GetTypeUrl(), resp.GetVersionInfo(), resp.GetNonce())
+}
+
+func (f *Fleet) OnDeltaStreamOpen(_ context.Context, id int64, typ string) error {
+	Log.Debugf("delta stream %d open for %s", id, typ)
+	f.open(id, true)
+	return nil
+}
+
+func (f *Fleet) OnDeltaStreamClosed(id int64) {
+	Log.Debugf("delta stream %d closed", id)
+	f.close(id)
+}
+
+// OnStreamDeltaRequest has no version info, an ACK accepts the sent version.
+func (f *Fleet) OnStreamDeltaRequest(id int64, req *discovery.DeltaDiscoveryRequest) error {
+	var detail error
+	if req.GetErrorDetail() != nil {
+		detail = fmt.Errorf("%s", req.GetErrorDetail().GetMessage())
+	}
+	f.mu.RLock()
+	version := ""
+	if s, ok := f.streams[id]; ok {
+		if r, ok := s.Resources[req.GetTypeUrl()]; ok {
+			version = r.SentVersion
+		}
+	}
+	f.mu.RUnlock()
+	f.request(id, req.GetNode(), req.GetTypeUrl(), version, req.GetResponseNonce(), detail)
+	return nil
+}
+
+func (f *Fleet) OnStreamDeltaResponse(id int64, _ *discovery.DeltaDiscoveryRequest, resp *discovery.DeltaDiscoveryResponse) {
+	f.response(id, resp.GetTypeUrl(), resp.GetSystemVersionInfo(), resp.GetNonce())
+}
+
+// REST fetches are not streams, there is nothing to follow.
+func (f *Fleet) OnFetchRequest(_ context.Context, req *discovery.DiscoveryRequest) error {
+	Log.Debugf("fetch %s by %s", req.GetTypeUrl(), req.GetNode().GetId())
+	return nil
+}
+
+func (f *Fleet) OnFetchResponse(*discovery.DiscoveryRequest, *discovery.DiscoveryResponse) {}
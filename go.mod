@@ -6,5 +6,7 @@ require (
 	github.com/envoyproxy/go-control-plane v0.9.9
 	github.com/gin-gonic/gin v1.7.2
 	github.com/golang/protobuf v1.5.2
+	go.etcd.io/bbolt v1.3.6
 	google.golang.org/grpc v1.38.0
+	gopkg.in/yaml.v2 v2.2.8
 )
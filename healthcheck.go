@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const HealthCheckHTTP = "http"
+const HealthCheckTCP = "tcp"
+const HealthCheckGRPC = "grpc"
+
+// HealthCheck probes every endpoint of a cluster each Interval, an endpoint
+// is ejected after UnhealthyThreshold failed probes in a row and brought
+// back after HealthyThreshold good ones.
+//
+// HTTP probes GET Path on Host and expect one of ExpectedStatuses, single
+// codes or ranges like 200-299 (200 by default). TCP probes connect and,
+// with Send set, expect Receive back. gRPC probes call the health service
+// for ServiceName.
+type HealthCheck struct {
+	Type               string
+	Path               string
+	Host               string
+	ExpectedStatuses   []string
+	Send               string
+	Receive            string
+	ServiceName        string
+	Interval           string
+	Timeout            string
+	HealthyThreshold   uint32
+	UnhealthyThreshold uint32
+}
+
+// statusRange is a range of HTTP statuses, end excluded.
+type statusRange struct {
+	start, end int64
+}
+
+func parseStatusRange(s string) (statusRange, error) {
+	first, last := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		first, last = s[:i], s[i+1:]
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return statusRange{}, fmt.Errorf("expected status %q is not a status or a range", s)
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		return statusRange{}, fmt.Errorf("expected status %q is not a status or a range", s)
+	}
+	if start < 100 || end > 599 || start > end {
+		return statusRange{}, fmt.Errorf("expected status %q is not within 100-599", s)
+	}
+	return statusRange{start, end + 1}, nil
+}
+
+// check fills in the defaults and validates the probe.
+func (hc *HealthCheck) check() error {
+	hc.Type = strings.ToLower(hc.Type)
+	switch hc.Type {
+	case HealthCheckHTTP:
+		if hc.Path == "" {
+			return errors.New("HTTP health check needs a Path")
+		}
+		for _, s := range hc.ExpectedStatuses {
+			if _, err := parseStatusRange(s); err != nil {
+				return err
+			}
+		}
+	case HealthCheckTCP:
+		if hc.Receive != "" && hc.Send == "" {
+			return errors.New("TCP health check expects to Receive without a Send")
+		}
+	case HealthCheckGRPC:
+	default:
+		return fmt.Errorf("health check Type %q is not http, tcp or grpc", hc.Type)
+	}
+	if hc.Interval == "" {
+		hc.Interval = "10s"
+	}
+	if hc.Timeout == "" {
+		hc.Timeout = "5s"
+	}
+	if hc.HealthyThreshold == 0 {
+		hc.HealthyThreshold = 2
+	}
+	if hc.UnhealthyThreshold == 0 {
+		hc.UnhealthyThreshold = 3
+	}
+	if d, err := time.ParseDuration(hc.Interval); err != nil || d <= 0 {
+		return fmt.Errorf("health check Interval %q is not a positive duration", hc.Interval)
+	}
+	if d, err := time.ParseDuration(hc.Timeout); err != nil || d <= 0 {
+		return fmt.Errorf("health check Timeout %q is not a positive duration", hc.Timeout)
+	}
+	return nil
+}
+
+// checkHealthChecks validates the probes of a cluster, gRPC probes need the
+// cluster to speak HTTP/2. The protocol must have been checked first.
+func (c *Cluster) checkHealthChecks() error {
+	for _, hc := range c.HealthChecks {
+		if hc == nil {
+			return fmt.Errorf("Cluster %s has an empty health check", c.Name)
+		}
+		if err := hc.check(); err != nil {
+			return fmt.Errorf("Cluster %s %s", c.Name, err)
+		}
+		if hc.Type == HealthCheckGRPC && c.Protocol != ProtocolHTTP2 {
+			return fmt.Errorf("Cluster %s gRPC health check needs Protocol http2", c.Name)
+		}
+	}
+	return nil
+}
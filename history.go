@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+)
+
+// Revision is a published snapshot together with the configuration that
+// produced it.
+type Revision struct {
+	Version   string
+	Created   time.Time
+	State     *State                    `json:",omitempty"`
+	Snapshots map[string]cache.Snapshot `json:"-"`
+	// Nacks lists the nodes that rejected the snapshots
+	Nacks []Nack `json:",omitempty"`
+}
+
+// History keeps the last published revisions, oldest first.
+type History struct {
+	mu        sync.Mutex
+	depth     int
+	revisions []*Revision
+}
+
+func NewHistory(depth int) *History {
+	return &History{depth: depth}
+}
+
+// Record stores a copy of state as the revision of the snapshots of every
+// node group.
+func (h *History) Record(version string, snapshots map[string]cache.Snapshot, state State) {
+	copied, err := state.Copy()
+	if err != nil {
+		Log.Errorf("history: failed to copy state: %s", err)
+		return
+	}
+	rev := &Revision{
+		Version:   version,
+		Created:   time.Now(),
+		State:     &copied,
+		Snapshots: snapshots,
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.revisions = append(h.revisions, rev)
+	if len(h.revisions) > h.depth {
+		h.revisions = h.revisions[len(h.revisions)-h.depth:]
+	}
+}
+
+// Get returns a copy of the revision of snapshot version.
+func (h *History) Get(version string) (*Revision, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, rev := range h.revisions {
+		if rev.Version == version {
+			copied := *rev
+			copied.Nacks = append([]Nack(nil), rev.Nacks...)
+			return &copied, true
+		}
+	}
+	return nil, false
+}
+
+// Nack records n on the revision of version, if it is still kept.
+func (h *History) Nack(version string, n Nack) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, rev := range h.revisions {
+		if rev.Version == version {
+			rev.Nacks = append(rev.Nacks, n)
+			return
+		}
+	}
+}
+
+// List returns the retained revisions without their states, newest first.
+func (h *History) List() []Revision {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := make([]Revision, 0, len(h.revisions))
+	for i := len(h.revisions) - 1; i >= 0; i-- {
+		list = append(list, Revision{
+			Version: h.revisions[i].Version,
+			Created: h.revisions[i].Created,
+			Nacks:   append([]Nack(nil), h.revisions[i].Nacks...),
+		})
+	}
+	return list
+}
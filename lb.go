@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// lbPolicies are the load balancing policies a cluster can pick from,
+// ROUND_ROBIN is the default.
+var lbPolicies = map[string]bool{
+	"ROUND_ROBIN":   true,
+	"LEAST_REQUEST": true,
+	"RANDOM":        true,
+	"RING_HASH":     true,
+	"MAGLEV":        true,
+}
+
+// RingHash tunes the RING_HASH policy, HashFunction is XX_HASH (default) or
+// MURMUR_HASH_2.
+type RingHash struct {
+	MinimumRingSize uint64
+	MaximumRingSize uint64
+	HashFunction    string
+}
+
+// Maglev tunes the MAGLEV policy, TableSize must be a prime number.
+type Maglev struct {
+	TableSize uint64
+}
+
+// HashPolicy hashes requests of a route on one of a header, a cookie, the
+// source IP or a query parameter so the RING_HASH and MAGLEV clusters keep
+// sending them to the same host. A missing cookie is generated by Envoy
+// when CookieTTL is set. Terminal skips the next policies once this one
+// produced a hash.
+type HashPolicy struct {
+	Header         string
+	Cookie         string
+	CookieTTL      string
+	CookiePath     string
+	SourceIP       bool
+	QueryParameter string
+	Terminal       bool
+}
+
+// checkLb normalizes the policy name and validates its options.
+func (c *Cluster) checkLb() error {
+	c.LbPolicy = strings.ToUpper(c.LbPolicy)
+	if c.LbPolicy == "" {
+		c.LbPolicy = "ROUND_ROBIN"
+	}
+	if !lbPolicies[c.LbPolicy] {
+		return fmt.Errorf("Cluster %s LbPolicy %s is not ROUND_ROBIN, LEAST_REQUEST, RANDOM, RING_HASH or MAGLEV", c.Name, c.LbPolicy)
+	}
+	if c.RingHash != nil {
+		if c.LbPolicy != "RING_HASH" {
+			return fmt.Errorf("Cluster %s has RingHash options without the RING_HASH policy", c.Name)
+		}
+		if err := c.RingHash.check(); err != nil {
+			return fmt.Errorf("Cluster %s %s", c.Name, err)
+		}
+	}
+	if c.Maglev != nil {
+		if c.LbPolicy != "MAGLEV" {
+			return fmt.Errorf("Cluster %s has Maglev options without the MAGLEV policy", c.Name)
+		}
+		if c.Maglev.TableSize != 0 && !prime(c.Maglev.TableSize) {
+			return fmt.Errorf("Cluster %s Maglev TableSize %d is not a prime", c.Name, c.Maglev.TableSize)
+		}
+	}
+	return nil
+}
+
+func (rh *RingHash) check() error {
+	rh.HashFunction = strings.ToUpper(rh.HashFunction)
+	switch rh.HashFunction {
+	case "":
+		rh.HashFunction = "XX_HASH"
+	case "XX_HASH", "MURMUR_HASH_2":
+	default:
+		return fmt.Errorf("ring hash function %s is not XX_HASH or MURMUR_HASH_2", rh.HashFunction)
+	}
+	if rh.MaximumRingSize != 0 && rh.MinimumRingSize > rh.MaximumRingSize {
+		return errors.New("MinimumRingSize is larger than MaximumRingSize")
+	}
+	if rh.MaximumRingSize > 8388608 {
+		return errors.New("MaximumRingSize is larger than 8388608")
+	}
+	return nil
+}
+
+func prime(n uint64) bool {
+	if n < 2 {
+		return false
+	}
+	for i := uint64(2); i*i <= n; i++ {
+		if n%i == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (h HashPolicy) check() error {
+	set := 0
+	for _, ok := range []bool{h.Header != "", h.Cookie != "", h.SourceIP, h.QueryParameter != ""} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("hash policy needs one of Header, Cookie, SourceIP and QueryParameter")
+	}
+	if (h.CookieTTL != "" || h.CookiePath != "") && h.Cookie == "" {
+		return errors.New("hash policy has cookie options without a Cookie")
+	}
+	return checkDuration("hash policy CookieTTL", h.CookieTTL)
+}
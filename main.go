@@ -17,10 +17,12 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"log"
+	"sync"
+	"time"
 
 	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/server/v3"
-	"github.com/envoyproxy/go-control-plane/pkg/test/v3"
 	"github.com/gin-gonic/gin"
 )
 
@@ -33,9 +35,23 @@ var (
 
 	nodeID string
 
+	storeType string
+	storePath string
+
+	oplogPath    string
+	oplogCompact int
+
+	historyDepth int
+
+	nackRevert bool
+
+	metricsURL string
+
 	CF Configuration
 
 	SCache cache.SnapshotCache
+
+	FleetStatus *Fleet
 )
 
 func init() {
@@ -46,20 +62,101 @@ func init() {
 	// The port that this xDS server listens on
 	flag.UintVar(&port, "port", 18000, "xDS management server port")
 
-	// Tell Envoy to use this Node ID
-	flag.StringVar(&nodeID, "nodeID", "test-id", "Node ID")
+	// Nodes outside of every node group are served the default group
+	flag.StringVar(&nodeID, "nodeID", "test-id", "Default node group, serves resources without groups to unmatched nodes")
+
+	// Where to keep the configuration between restarts
+	flag.StringVar(&storeType, "store", "", "Configuration store type (file, bolt), empty keeps it in memory only")
+	flag.StringVar(&storePath, "storePath", "majakka.db", "Configuration store location")
+
+	// Log every mutation before applying it, to recover from crashes
+	flag.StringVar(&oplogPath, "oplog", "", "Operation log location, empty disables the log")
+	flag.IntVar(&oplogCompact, "oplogCompact", 1000, "Compact the operation log into a checkpoint after this many entries")
+
+	// How many published snapshots can be rolled back to
+	flag.IntVar(&historyDepth, "history", 10, "Number of snapshots kept for rollback, 0 disables the history")
+
+	// What to serve a node group after one of its nodes rejected a snapshot
+	flag.BoolVar(&nackRevert, "nackRevert", false, "Serve a node group the last snapshot all its nodes ACKed when one of them rejects a new one")
+
+	// Where rollouts evaluate their metric gates
+	flag.StringVar(&metricsURL, "metricsURL", "", "Prometheus compatible API for rollout metric gates, \"stub\" answers 0 to every query")
 }
 
 func main() {
 	flag.Parse()
 
 	CF = Configuration{
-		Clusters:  make(ClustersMap),
-		Listeners: make(ListenersMap),
-		RouteConf: make(RouteConfMap),
+		Clusters:   make(ClustersMap),
+		Listeners:  make(ListenersMap),
+		RouteConf:  make(RouteConfMap),
+		NodeGroups: make(NodeGroupsMap),
+		Rollouts:   make(RolloutsMap),
+		BlueGreens: make(BlueGreensMap),
+		Previews:   make(PreviewsMap),
+		Secrets:    make(SecretsMap),
+		Generation: &Generation{},
+		Hash:       NewGroupHash(nodeID),
+		mu:         new(sync.RWMutex),
+	}
+
+	if historyDepth > 0 {
+		CF.History = NewHistory(historyDepth)
+	}
+
+	store, err := NewStore(storeType, storePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if store != nil {
+		defer store.Close()
+		CF.Store = store
+	}
+	if oplogPath != "" {
+		// without a store the checkpoints are kept next to the log
+		checkpoint := store
+		if checkpoint == nil {
+			checkpoint = &FileStore{Path: oplogPath + ".checkpoint"}
+		}
+		oplog, err := OpenOpLog(oplogPath, checkpoint, oplogCompact)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer oplog.Close()
+		recovered, err := oplog.Recover(CF)
+		if err != nil {
+			log.Fatalf("failed to recover from %s: %s", oplogPath, err)
+		}
+		log.Printf("recovered %d operations from %s", recovered, oplogPath)
+		CF.OpLog = oplog
+	} else if store != nil {
+		state, err := store.Load()
+		if err != nil {
+			log.Fatalf("failed to load configuration from %s: %s", storePath, err)
+		}
+		CF.Restore(state)
+		CF.Generation.Resume(state.Version, 0)
+	}
+
+	// Create a cache
+	SCache = cache.NewSnapshotCache(false, CF.Hash, Log)
+	CF.SnapshotCache = &SCache
+
+	// Follow which versions the connected nodes have applied
+	FleetStatus = NewFleet(CF.Hash, CF.Rejected)
+
+	// Serve the restored configuration before Envoy reconnects
+	if err := CF.GenerateSnapshot(); err != nil {
+		log.Fatalf("restored configuration is not valid: %s", err)
+	}
+	if CF.OpLog != nil {
+		if err := CF.OpLog.Compact(CF.State()); err != nil {
+			log.Fatalf("failed to checkpoint recovered configuration: %s", err)
+		}
 	}
 
 	controlapi := gin.Default()
+	controlapi.Use(WaitOptions)
 	controlapi.GET("/control/info", CInfo)
 	controlapi.POST("/control/listener/add", AddListener)
 	controlapi.POST("/control/cluster/add", AddCluster)
@@ -68,17 +165,81 @@ func main() {
 	controlapi.POST("/control/endpoint/delete", DeleteEndpoint)
 	controlapi.POST("/control/endpoint/switch", SwitchEndpoint)
 	controlapi.POST("/control/mirroring/add", AddMirroring)
+	controlapi.GET("/control/clusters", ListClusters)
+	controlapi.GET("/control/clusters/:name", GetCluster)
+	controlapi.PUT("/control/clusters/:name", PutCluster)
+	controlapi.PATCH("/control/clusters/:name", PatchCluster)
+	controlapi.DELETE("/control/clusters/:name", DeleteCluster)
+	controlapi.GET("/control/routes", ListRoutes)
+	controlapi.GET("/control/routes/:name", GetRoute)
+	controlapi.PUT("/control/routes/:name", PutRoute)
+	controlapi.PATCH("/control/routes/:name", PatchRoute)
+	controlapi.DELETE("/control/routes/:name", DeleteRoute)
+	controlapi.GET("/control/routes/:name/mirrors", ListMirrors)
+	controlapi.GET("/control/routes/:name/mirrors/:cluster", GetMirror)
+	controlapi.PUT("/control/routes/:name/mirrors/:cluster", PutMirror)
+	controlapi.PATCH("/control/routes/:name/mirrors/:cluster", PatchMirror)
+	controlapi.DELETE("/control/routes/:name/mirrors/:cluster", DeleteMirror)
+	controlapi.PUT("/control/routes/:name/weights", SetWeights)
+	controlapi.PUT("/control/routes/:name/rules/:rule/weights", SetWeights)
+	controlapi.PUT("/control/routes/:name/vhosts/:vhost/rules/:rule/weights", SetWeights)
+	controlapi.GET("/control/routes/:name/vhosts", ListVHosts)
+	controlapi.GET("/control/routes/:name/vhosts/:vhost", GetVHost)
+	controlapi.PUT("/control/routes/:name/vhosts/:vhost", PutVHost)
+	controlapi.DELETE("/control/routes/:name/vhosts/:vhost", DeleteVHost)
+	controlapi.POST("/control/routes/:name/vhosts/:vhost/rules", AddRouteRule)
+	controlapi.DELETE("/control/routes/:name/vhosts/:vhost/rules/:rule", DeleteRouteRule)
+	controlapi.GET("/control/listeners", ListListeners)
+	controlapi.GET("/control/listeners/:name", GetListener)
+	controlapi.PUT("/control/listeners/:name", PutListener)
+	controlapi.PATCH("/control/listeners/:name", PatchListener)
+	controlapi.DELETE("/control/listeners/:name", DeleteListener)
+	controlapi.GET("/control/rollouts", ListRollouts)
+	controlapi.GET("/control/rollouts/:name", GetRollout)
+	controlapi.PUT("/control/rollouts/:name", PutRollout)
+	controlapi.DELETE("/control/rollouts/:name", DeleteRollout)
+	controlapi.POST("/control/rollouts/:name/pause", PauseRollout)
+	controlapi.POST("/control/rollouts/:name/resume", ResumeRollout)
+	controlapi.POST("/control/rollouts/:name/abort", AbortRollout)
+	controlapi.GET("/control/bluegreens", ListBlueGreens)
+	controlapi.GET("/control/bluegreens/:name", GetBlueGreen)
+	controlapi.PUT("/control/bluegreens/:name", PutBlueGreen)
+	controlapi.DELETE("/control/bluegreens/:name", DeleteBlueGreen)
+	controlapi.POST("/control/bluegreens/:name/flip", FlipBlueGreen)
+	controlapi.GET("/control/previews", ListPreviews)
+	controlapi.GET("/control/previews/:name", GetPreview)
+	controlapi.PUT("/control/previews/:name", PutPreview)
+	controlapi.DELETE("/control/previews/:name", DeletePreview)
+	controlapi.GET("/control/secrets", ListSecrets)
+	controlapi.GET("/control/secrets/:name", GetSecret)
+	controlapi.PUT("/control/secrets/:name", PutSecret)
+	controlapi.DELETE("/control/secrets/:name", DeleteSecret)
+	controlapi.GET("/control/nodegroups", ListNodeGroups)
+	controlapi.GET("/control/nodegroups/:name", GetNodeGroup)
+	controlapi.PUT("/control/nodegroups/:name", PutNodeGroup)
+	controlapi.DELETE("/control/nodegroups/:name", DeleteNodeGroup)
+	controlapi.POST("/control/batch", Batch)
+	controlapi.POST("/control/apply", Apply)
+	controlapi.GET("/control/nodes", ListNodes)
+	controlapi.GET("/control/snapshots", ListSnapshots)
+	controlapi.GET("/control/snapshots/:version", GetSnapshot)
+	controlapi.POST("/control/snapshots/:version/rollback", RollbackSnapshot)
+
+	// Step the rollouts
+	var metrics MetricSource
+	if metricsURL != "" {
+		metrics = NewMetricSource(metricsURL)
+	}
+	go NewRolloutController(CF, metrics).Run(time.Second)
+
+	// Tear down the expired previews
+	go ReapPreviews(CF, time.Second)
 
 	httpport := fmt.Sprintf(":8099")
 	go controlapi.Run(httpport)
 
-	// Create a cache
-	SCache = cache.NewSnapshotCache(false, cache.IDHash{}, Log)
-	CF.SnapshotCache = &SCache
-
 	// Run the xDS server
 	ctx := context.Background()
-	cb := &test.Callbacks{Debug: Log.Debug}
-	srv := server.NewServer(ctx, SCache, cb)
+	srv := server.NewServer(ctx, SCache, FleetStatus)
 	RunServer(ctx, srv, port)
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MetricSource evaluates the gate queries of rollouts to a single value.
+type MetricSource interface {
+	Query(query string) (float64, error)
+}
+
+// NewMetricSource returns the source for addr: "stub" answers every query
+// with 0, anything else is the base URL of a Prometheus compatible API.
+func NewMetricSource(addr string) MetricSource {
+	if addr == "stub" {
+		return &StubSource{}
+	}
+	return &PrometheusSource{
+		URL:    strings.TrimRight(addr, "/"),
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// StubSource answers the queries listed in Values, and every other query
+// with Default. Every query fails with Err if set.
+type StubSource struct {
+	Values  map[string]float64
+	Default float64
+	Err     error
+}
+
+func (s *StubSource) Query(query string) (float64, error) {
+	if s.Err != nil {
+		return 0, s.Err
+	}
+	if v, ok := s.Values[query]; ok {
+		return v, nil
+	}
+	return s.Default, nil
+}
+
+// PrometheusSource runs instant queries against the Prometheus HTTP API,
+// the first sample of the result is the value.
+type PrometheusSource struct {
+	URL    string
+	Client *http.Client
+}
+
+type prometheusResponse struct {
+	Status string
+	Error  string
+	Data   struct {
+		ResultType string
+		Result     json.RawMessage
+	}
+}
+
+func (p *PrometheusSource) Query(query string) (float64, error) {
+	resp, err := p.Client.Get(p.URL + "/api/v1/query?query=" + url.QueryEscape(query))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var body prometheusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, fmt.Errorf("%s: %s", resp.Status, err)
+	}
+	if body.Status != "success" {
+		return 0, fmt.Errorf("query failed: %s", body.Error)
+	}
+
+	var sample []interface{}
+	switch body.Data.ResultType {
+	case "scalar":
+		if err := json.Unmarshal(body.Data.Result, &sample); err != nil {
+			return 0, err
+		}
+	case "vector":
+		var vector []struct {
+			Value []interface{}
+		}
+		if err := json.Unmarshal(body.Data.Result, &vector); err != nil {
+			return 0, err
+		}
+		if len(vector) == 0 {
+			return 0, errors.New("query returned no data")
+		}
+		sample = vector[0].Value
+	default:
+		return 0, fmt.Errorf("query returned a %s, not a scalar or vector", body.Data.ResultType)
+	}
+
+	if len(sample) != 2 {
+		return 0, errors.New("query returned a malformed sample")
+	}
+	s, ok := sample[1].(string)
+	if !ok {
+		return 0, errors.New("query returned a malformed sample")
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(value) {
+		return 0, errors.New("query returned NaN")
+	}
+	return value, nil
+}
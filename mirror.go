@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	v3types "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+)
+
+// Mirror shadows Numerator out of Denominator (HUNDRED, TEN_THOUSAND or
+// MILLION, HUNDRED by default) of the requests to a cluster. The share can
+// be changed at runtime under RuntimeKey, which defaults to
+// mirror.<route>.<cluster>.
+type Mirror struct {
+	Numerator   uint32
+	Denominator string
+	RuntimeKey  string
+}
+
+// UnmarshalJSON also reads a bare number, mirrors used to be a percentage.
+func (m *Mirror) UnmarshalJSON(data []byte) error {
+	var percent uint32
+	if err := json.Unmarshal(data, &percent); err == nil {
+		*m = Mirror{Numerator: percent, Denominator: "HUNDRED"}
+		return nil
+	}
+	type mirror Mirror
+	return json.Unmarshal(data, (*mirror)(m))
+}
+
+func (m *Mirror) denominator() v3types.FractionalPercent_DenominatorType {
+	return v3types.FractionalPercent_DenominatorType(v3types.FractionalPercent_DenominatorType_value[m.Denominator])
+}
+
+var denominatorMax = map[string]uint32{
+	"HUNDRED":      100,
+	"TEN_THOUSAND": 10000,
+	"MILLION":      1000000,
+}
+
+// check normalizes the denominator and validates the fraction.
+func (m *Mirror) check() error {
+	if m.Denominator == "" {
+		m.Denominator = "HUNDRED"
+	}
+	m.Denominator = strings.ToUpper(m.Denominator)
+	max, ok := denominatorMax[m.Denominator]
+	if !ok {
+		return fmt.Errorf("denominator %s is not HUNDRED, TEN_THOUSAND or MILLION", m.Denominator)
+	}
+	if m.Numerator > max {
+		return fmt.Errorf("numerator %d is more than %d", m.Numerator, max)
+	}
+	return nil
+}
+
+func (m *Mirror) runtimeKey(route, cluster string) string {
+	if m.RuntimeKey != "" {
+		return m.RuntimeKey
+	}
+	return "mirror." + route + "." + cluster
+}
+
+// checkMirror makes sure m is a valid fraction of requests to a cluster that
+// exists.
+func (cf Configuration) checkMirror(cluster string, m *Mirror) error {
+	if m == nil {
+		return fmt.Errorf("Mirror %s is empty", cluster)
+	}
+	if err := m.check(); err != nil {
+		return fmt.Errorf("Mirror %s %s", cluster, err)
+	}
+	if _, ok := cf.Clusters[cluster]; !ok {
+		return fmt.Errorf("Cluster %s %w", cluster, ErrNotFound)
+	}
+	return nil
+}
+
+// PatchMirroring changes some fields of a mirror, the others are kept.
+func (cf Configuration) PatchMirroring(route, cluster string, patch json.RawMessage) error {
+	return cf.Execute(Operation{Op: OpPatchMirroring, Route: route, Cluster: cluster, Patch: patch})
+}
+
+func (cf Configuration) patchMirroring(route, cluster string, patch json.RawMessage) error {
+	r, ok := cf.RouteConf[route]
+	if !ok {
+		return fmt.Errorf("Route %s %w", route, ErrNotFound)
+	}
+	old, ok := r.Mirroring[cluster]
+	if !ok {
+		return fmt.Errorf("Mirror %s %w", cluster, ErrNotFound)
+	}
+	m := &Mirror{}
+	if err := patchCopy(old, patch, m); err != nil {
+		return err
+	}
+	return cf.addMirroring(route, cluster, m)
+}
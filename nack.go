@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+)
+
+// Nack is a snapshot version an Envoy node rejected.
+type Nack struct {
+	Node    string
+	Group   string
+	Type    string
+	Version string
+	Error   string
+	At      time.Time
+	// LastAcked is the newest version every node of the group ACKed
+	LastAcked  string `json:",omitempty"`
+	RevertedTo string `json:",omitempty"`
+}
+
+// versionGeneration returns the generation of a snapshot version, the
+// versions of node groups are suffixed with the group name.
+func versionGeneration(version string) (uint64, error) {
+	if i := strings.IndexByte(version, '/'); i >= 0 {
+		version = version[:i]
+	}
+	return strconv.ParseUint(version, 10, 64)
+}
+
+// Rejected records n on the revision that published the rejected version
+// and, with autoRevert, serves the group the last snapshot all its nodes
+// ACKed again.
+func (cf Configuration) Rejected(n Nack) {
+	if cf.History == nil {
+		return
+	}
+	generation, err := versionGeneration(n.Version)
+	if err != nil {
+		Log.Warnf("nack: unknown version %q rejected by %s", n.Version, n.Node)
+		return
+	}
+	version := strconv.FormatUint(generation, 10)
+	if nackRevert {
+		n.RevertedTo = cf.revert(n)
+	}
+	cf.History.Nack(version, n)
+}
+
+// revert replaces the rejected snapshot of the group with the one of the
+// last version ACKed by all its nodes, and returns that version. The
+// configuration is not changed, the next published snapshot contains the
+// rejected change again unless it is fixed or rolled back.
+func (cf Configuration) revert(n Nack) string {
+	if n.LastAcked == "" {
+		Log.Warnf("nack: no version of group %s was ACKed by all nodes, not reverting", n.Group)
+		return ""
+	}
+	acked, err := versionGeneration(n.LastAcked)
+	if err != nil {
+		return ""
+	}
+	rev, ok := cf.History.Get(strconv.FormatUint(acked, 10))
+	if !ok {
+		Log.Warnf("nack: version %s is no longer in the history, not reverting", n.LastAcked)
+		return ""
+	}
+	snapshot, ok := rev.Snapshots[n.Group]
+	if !ok {
+		return ""
+	}
+
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	scache := *cf.SnapshotCache
+	current, err := scache.GetSnapshot(n.Group)
+	if err != nil || current.GetVersion(resource.ClusterType) != n.Version {
+		// already reverted or replaced by a newer snapshot
+		return ""
+	}
+	if err := scache.SetSnapshot(n.Group, snapshot); err != nil {
+		Log.Errorf("nack: failed to revert group %s: %s", n.Group, err)
+		return ""
+	}
+	reverted := snapshot.GetVersion(resource.ClusterType)
+	Log.Warnf("nack: group %s reverted from version %s to %s", n.Group, n.Version, reverted)
+	return reverted
+}
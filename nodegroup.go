@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+)
+
+type NodeGroupsMap map[string]*NodeGroup
+
+// NodeGroup selects the Envoy nodes that are served the resources assigned
+// to the group. A node belongs to the group if its ID is listed, or if its
+// cluster is listed, or if all of Metadata matches its metadata.
+type NodeGroup struct {
+	Name     string
+	Nodes    []string
+	Clusters []string
+	Metadata map[string]string
+}
+
+func (g *NodeGroup) matchesCluster(node *core.Node) bool {
+	for _, c := range g.Clusters {
+		if c == node.GetCluster() {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *NodeGroup) matchesMetadata(node *core.Node) bool {
+	if len(g.Metadata) == 0 {
+		return false
+	}
+	fields := node.GetMetadata().GetFields()
+	for k, v := range g.Metadata {
+		if fields[k].GetStringValue() != v {
+			return false
+		}
+	}
+	return true
+}
+
+// inGroup reports whether a resource assigned to groups is served to group,
+// resources without groups are served to every group.
+func inGroup(groups []string, group string) bool {
+	if len(groups) == 0 {
+		return true
+	}
+	for _, g := range groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// GroupHash maps Envoy nodes to the snapshot of their node group, nodes
+// without a group get the snapshot of the default group.
+type GroupHash struct {
+	mu        sync.RWMutex
+	defaultID string
+	groups    []NodeGroup
+}
+
+func NewGroupHash(defaultID string) *GroupHash {
+	return &GroupHash{defaultID: defaultID}
+}
+
+func (h *GroupHash) ID(node *core.Node) string {
+	if node == nil {
+		return h.defaultID
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	// a listed node ID is the most specific match
+	for _, g := range h.groups {
+		for _, id := range g.Nodes {
+			if id == node.GetId() {
+				return g.Name
+			}
+		}
+	}
+	for _, g := range h.groups {
+		if g.matchesCluster(node) {
+			return g.Name
+		}
+	}
+	for _, g := range h.groups {
+		if g.matchesMetadata(node) {
+			return g.Name
+		}
+	}
+	return h.defaultID
+}
+
+// Update replaces the node groups, they are matched in name order.
+func (h *GroupHash) Update(groups NodeGroupsMap) {
+	list := make([]NodeGroup, 0, len(groups))
+	for _, g := range groups {
+		list = append(list, *g)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.groups = list
+}
+
+// Groups returns the snapshot keys: the default group and every node group.
+func (cf Configuration) Groups() []string {
+	groups := []string{nodeID}
+	for name := range cf.NodeGroups {
+		if name != nodeID {
+			groups = append(groups, name)
+		}
+	}
+	sort.Strings(groups[1:])
+	return groups
+}
+
+// snapshotVersion keeps the versions of different groups apart, so a node
+// moved to another group never looks up to date there.
+func snapshotVersion(version, group string) string {
+	if group == nodeID {
+		return version
+	}
+	return version + "/" + group
+}
+
+func (cf Configuration) PutNodeGroup(g *NodeGroup) error {
+	return cf.Execute(Operation{Op: OpPutNodeGroup, Name: g.Name, NodeGroup: g})
+}
+
+func (cf Configuration) DeleteNodeGroup(name string) error {
+	return cf.Execute(Operation{Op: OpDeleteNodeGroup, Name: name})
+}
+
+func (cf Configuration) putNodeGroup(g *NodeGroup) error {
+	if g == nil || g.Name == "" {
+		return errors.New("Node group name is required")
+	}
+	if g.Name == nodeID {
+		return fmt.Errorf("Node group %s is the default group", g.Name)
+	}
+	cf.NodeGroups[g.Name] = g
+	return nil
+}
+
+// checkGroups makes sure the node groups a resource is assigned to exist,
+// a misspelled group would keep it from every node.
+func (cf Configuration) checkGroups(groups []string) error {
+	for _, g := range groups {
+		if _, ok := cf.NodeGroups[g]; !ok && g != nodeID {
+			return fmt.Errorf("Node group %s %w", g, ErrNotFound)
+		}
+	}
+	return nil
+}
+
+// deleteNodeGroup refuses to delete a group resources are assigned to, as
+// dropping the assignment would serve them to every node.
+func (cf Configuration) deleteNodeGroup(name string) error {
+	if _, ok := cf.NodeGroups[name]; !ok {
+		return fmt.Errorf("Node group %s %w", name, ErrNotFound)
+	}
+	var refs []string
+	for _, c := range cf.Clusters {
+		if len(c.Groups) > 0 && inGroup(c.Groups, name) {
+			refs = append(refs, "cluster/"+c.Name)
+		}
+	}
+	for _, r := range cf.RouteConf {
+		if len(r.Groups) > 0 && inGroup(r.Groups, name) {
+			refs = append(refs, "route/"+r.Name)
+		}
+	}
+	for _, l := range cf.Listeners {
+		if len(l.Groups) > 0 && inGroup(l.Groups, name) {
+			refs = append(refs, "listener/"+l.Name)
+		}
+	}
+	if len(refs) > 0 {
+		sort.Strings(refs)
+		return fmt.Errorf("Node group %s is %w by %s", name, ErrReferenced, strings.Join(refs, ", "))
+	}
+	delete(cf.NodeGroups, name)
+	return nil
+}
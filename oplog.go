@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	OpAddCluster      = "add_cluster"
+	OpAddEndpoint     = "add_endpoint"
+	OpDeleteEndpoint  = "delete_endpoint"
+	OpDisableEndpoint = "disable_endpoint"
+	OpEnableEndpoint  = "enable_endpoint"
+	OpAddRoute        = "add_route"
+	OpAddListener     = "add_listener"
+	OpAddMirroring    = "add_mirroring"
+	OpDeleteMirroring = "delete_mirroring"
+	OpPatchMirroring  = "patch_mirroring"
+	OpPutCluster      = "put_cluster"
+	OpPatchCluster    = "patch_cluster"
+	OpDeleteCluster   = "delete_cluster"
+	OpPutRoute        = "put_route"
+	OpPatchRoute      = "patch_route"
+	OpDeleteRoute     = "delete_route"
+	OpPutListener     = "put_listener"
+	OpPatchListener   = "patch_listener"
+	OpDeleteListener  = "delete_listener"
+	OpPutVHost        = "put_vhost"
+	OpDeleteVHost     = "delete_vhost"
+	OpAddRouteRule    = "add_route_rule"
+	OpDeleteRouteRule = "delete_route_rule"
+	OpSetWeights      = "set_weights"
+	OpPutRollout      = "put_rollout"
+	OpDeleteRollout   = "delete_rollout"
+	OpStepRollout     = "step_rollout"
+	OpPauseRollout    = "pause_rollout"
+	OpResumeRollout   = "resume_rollout"
+	OpAbortRollout    = "abort_rollout"
+	OpPutBlueGreen    = "put_bluegreen"
+	OpFlipBlueGreen   = "flip_bluegreen"
+	OpDeleteBlueGreen = "delete_bluegreen"
+	OpPutPreview      = "put_preview"
+	OpDeletePreview   = "delete_preview"
+	OpPutSecret       = "put_secret"
+	OpDeleteSecret    = "delete_secret"
+	OpPutNodeGroup    = "put_nodegroup"
+	OpDeleteNodeGroup = "delete_nodegroup"
+	OpRestore         = "restore"
+	OpBatch           = "batch"
+	OpApply           = "apply"
+)
+
+// Operation is a single Configuration mutation as it is written to the
+// operation log.
+type Operation struct {
+	Seq      uint64      `json:"seq,omitempty"`
+	Op       string      `json:"op"`
+	Name     string      `json:"name,omitempty"`
+	Cluster  string      `json:"cluster,omitempty"`
+	Route    string      `json:"route,omitempty"`
+	Address  string      `json:"address,omitempty"`
+	Port     uint32      `json:"port,omitempty"`
+	Fraction uint32      `json:"fraction,omitempty"`
+	State    *State      `json:"state,omitempty"`
+	Ops      []Operation `json:"ops,omitempty"`
+	Prune    bool        `json:"prune,omitempty"`
+	Cascade  bool        `json:"cascade,omitempty"`
+	Step     int         `json:"step,omitempty"`
+	Reason   string      `json:"reason,omitempty"`
+	Side     string      `json:"side,omitempty"`
+	At       *time.Time  `json:"at,omitempty"`
+
+	ClusterConf  *Cluster        `json:"clusterConf,omitempty"`
+	RouteConf    *RouteConf      `json:"routeConf,omitempty"`
+	ListenerConf *Listener       `json:"listenerConf,omitempty"`
+	NodeGroup    *NodeGroup      `json:"nodeGroup,omitempty"`
+	VHost        *VHost          `json:"vhost,omitempty"`
+	Rule         *RouteRule      `json:"rule,omitempty"`
+	Weights      ClusterWeights  `json:"weights,omitempty"`
+	Rollout      *Rollout        `json:"rollout,omitempty"`
+	BlueGreen    *BlueGreen      `json:"blueGreen,omitempty"`
+	Mirror       *Mirror         `json:"mirror,omitempty"`
+	Preview      *Preview        `json:"preview,omitempty"`
+	Secret       *Secret         `json:"secret,omitempty"`
+	Patch        json.RawMessage `json:"patch,omitempty"`
+
+	// applied receives the changes of an apply, nothing is logged or
+	// published when there are none
+	applied *ApplyResult
+}
+
+// OpLog is an append-only log of operations. Every operation is written
+// before it is published, so the configuration can be rebuilt after a crash
+// from the last checkpoint plus the operations logged after it.
+type OpLog struct {
+	mu           sync.Mutex
+	file         *os.File
+	checkpoint   Store
+	seq          uint64
+	entries      int
+	compactEvery int
+}
+
+// OpenOpLog opens the log at path, checkpoints are written to checkpoint and
+// the log is compacted once it holds compactEvery entries.
+func OpenOpLog(path string, checkpoint Store, compactEvery int) (*OpLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &OpLog{file: file, checkpoint: checkpoint, compactEvery: compactEvery}, nil
+}
+
+func (l *OpLog) Seq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq
+}
+
+// Append assigns the next sequence number to op and syncs it to disk.
+func (l *OpLog) Append(op *Operation) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	op.Seq = l.seq + 1
+	data, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	if _, err = l.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err = l.file.Sync(); err != nil {
+		return err
+	}
+	l.seq = op.Seq
+	l.entries++
+	return nil
+}
+
+func (l *OpLog) NeedsCompaction() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.compactEvery > 0 && l.entries >= l.compactEvery
+}
+
+// Compact writes state as a checkpoint and drops the log entries it covers.
+func (l *OpLog) Compact(state State) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if state.Seq != l.seq {
+		return errors.New("state is behind the operation log, not compacting")
+	}
+	if err := l.checkpoint.Save(state); err != nil {
+		return err
+	}
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	l.entries = 0
+	return l.file.Sync()
+}
+
+// Recover loads the last checkpoint into cf and replays the operations
+// logged after it, returning the number of replayed operations.
+func (l *OpLog) Recover(cf Configuration) (int, error) {
+	state, err := l.checkpoint.Load()
+	if err != nil {
+		return 0, err
+	}
+	cf.Restore(state)
+	recovered := 0
+	defer func() {
+		cf.Generation.Resume(state.Version, recovered)
+	}()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq = state.Seq
+	if _, err = l.file.Seek(0, 0); err != nil {
+		return 0, err
+	}
+	scanner := bufio.NewScanner(l.file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		l.entries++
+		var op Operation
+		if err := json.Unmarshal(scanner.Bytes(), &op); err != nil {
+			// only the last write can be torn by a crash
+			Log.Warnf("oplog: skipping unreadable entry after seq %d: %s", l.seq, err)
+			continue
+		}
+		if op.Seq <= l.seq {
+			continue
+		}
+		l.seq = op.Seq
+		if err := cf.replay(op); err != nil {
+			// the operation failed the same way when it was first executed
+			Log.Infof("oplog: replayed operation %d failed: %s", op.Seq, err)
+		}
+		recovered++
+	}
+	return recovered, scanner.Err()
+}
+
+func (l *OpLog) Close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// OutlierDetection ejects the endpoints of a cluster returning Consecutive5xx
+// 5xx or ConsecutiveGatewayFailure 502, 503 and 504 in a row, for
+// BaseEjectionTime times the number of ejections, while at most
+// MaxEjectionPercent of the endpoints are ejected. Endpoints are checked
+// every Interval. Unset fields keep the Envoy defaults, gateway failures are
+// only enforced once ConsecutiveGatewayFailure is set.
+type OutlierDetection struct {
+	Consecutive5xx            uint32
+	ConsecutiveGatewayFailure uint32
+	Interval                  string
+	BaseEjectionTime          string
+	MaxEjectionPercent        uint32
+}
+
+// CircuitBreakers are the thresholds of a cluster by routing priority,
+// default or high.
+type CircuitBreakers map[string]*Thresholds
+
+// Thresholds cap the connections, pending requests, requests and retries
+// to a cluster, 0 keeps the Envoy default.
+type Thresholds struct {
+	MaxConnections     uint32
+	MaxPendingRequests uint32
+	MaxRequests        uint32
+	MaxRetries         uint32
+}
+
+func (od *OutlierDetection) check() error {
+	if err := checkDuration("outlier detection Interval", od.Interval); err != nil {
+		return err
+	}
+	if err := checkDuration("outlier detection BaseEjectionTime", od.BaseEjectionTime); err != nil {
+		return err
+	}
+	if od.MaxEjectionPercent > 100 {
+		return fmt.Errorf("outlier detection MaxEjectionPercent %d is more than 100", od.MaxEjectionPercent)
+	}
+	return nil
+}
+
+// priorities lists the priorities in cb, default first.
+func (cb CircuitBreakers) priorities() []string {
+	var priorities []string
+	for _, p := range []string{"default", "high"} {
+		if _, ok := cb[p]; ok {
+			priorities = append(priorities, p)
+		}
+	}
+	return priorities
+}
+
+// checkResilience validates the outlier detection and the circuit breakers
+// of a cluster, priorities are lowercased.
+func (c *Cluster) checkResilience() error {
+	if c.OutlierDetection != nil {
+		if err := c.OutlierDetection.check(); err != nil {
+			return fmt.Errorf("Cluster %s %s", c.Name, err)
+		}
+	}
+	for priority, t := range c.CircuitBreakers {
+		lower := strings.ToLower(priority)
+		if lower != "default" && lower != "high" {
+			return fmt.Errorf("Cluster %s circuit breaker priority %s is not default or high", c.Name, priority)
+		}
+		if t == nil {
+			return fmt.Errorf("Cluster %s circuit breaker %s has no thresholds", c.Name, priority)
+		}
+		if lower != priority {
+			delete(c.CircuitBreakers, priority)
+			c.CircuitBreakers[lower] = t
+		}
+	}
+	return nil
+}
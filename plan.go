@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+)
+
+const ChangeAdded = "added"
+const ChangeChanged = "changed"
+const ChangeRemoved = "removed"
+
+// Plan collects what a dry-run mutation would change in the served
+// snapshot, nothing is published or logged.
+type Plan struct {
+	Changes []ResourceChange `json:"changes"`
+}
+
+// ResourceChange is a single Envoy resource added, changed or removed.
+type ResourceChange struct {
+	Group  string          `json:"group"`
+	Type   string          `json:"type"`
+	Name   string          `json:"name"`
+	Change string          `json:"change"`
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// DryRun returns a copy of cf that only plans mutations into the returned Plan.
+func (cf Configuration) DryRun() (Configuration, *Plan) {
+	plan := &Plan{Changes: []ResourceChange{}}
+	cf.plan = plan
+	return cf, plan
+}
+
+var diffTypes = []struct {
+	name string
+	typ  types.ResponseType
+}{
+	{"cluster", types.Cluster},
+	{"endpoint", types.Endpoint},
+	{"route", types.Route},
+	{"listener", types.Listener},
+	{"secret", types.Secret},
+}
+
+// diffSnapshots lists the resources that differ between old and new.
+func diffSnapshots(old, new cache.Snapshot) ([]ResourceChange, error) {
+	changes := []ResourceChange{}
+	for _, t := range diffTypes {
+		before := old.Resources[t.typ].Items
+		after := new.Resources[t.typ].Items
+
+		var names []string
+		for name := range before {
+			names = append(names, name)
+		}
+		for name := range after {
+			if _, ok := before[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			b, inBefore := before[name]
+			a, inAfter := after[name]
+			change := ResourceChange{Type: t.name, Name: name}
+			switch {
+			case !inBefore:
+				change.Change = ChangeAdded
+			case !inAfter:
+				change.Change = ChangeRemoved
+			case !proto.Equal(b.Resource, a.Resource):
+				change.Change = ChangeChanged
+			default:
+				continue
+			}
+			var err error
+			if inBefore {
+				if change.Before, err = marshalResource(b.Resource); err != nil {
+					return nil, err
+				}
+			}
+			if inAfter {
+				if change.After, err = marshalResource(a.Resource); err != nil {
+					return nil, err
+				}
+			}
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+// marshalResource renders res as JSON, without the private key of secrets.
+func marshalResource(res types.Resource) (json.RawMessage, error) {
+	if s, ok := res.(*tlsv3.Secret); ok && s.GetTlsCertificate().GetPrivateKey() != nil {
+		s = proto.Clone(s).(*tlsv3.Secret)
+		s.GetTlsCertificate().PrivateKey = makeDataSource(redactedKey)
+		res = s
+	}
+	m := jsonpb.Marshaler{}
+	data, err := m.MarshalToString(res)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(data), nil
+}
+
+// validateSnapshot runs the proto validation rules of every resource.
+func validateSnapshot(snapshot cache.Snapshot) error {
+	for _, resources := range snapshot.Resources {
+		for name, res := range resources.Items {
+			if v, ok := res.Resource.(interface{ Validate() error }); ok {
+				if err := v.Validate(); err != nil {
+					return fmt.Errorf("%s: %s", name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// previewHeader carries the preview name when a preview sets no Header or
+// Cookie.
+const previewHeader = "x-env"
+
+type PreviewsMap map[string]*Preview
+
+// Preview sends the requests of Route carrying Header: Value, or the Cookie
+// cookie set to Value, to a cluster of its own made of Endpoints. Everything
+// else goes through Route as usual. Value defaults to the preview name, the
+// rule goes first in the rules of VHost, or of the route itself if empty.
+// The cluster and the rule are named preview-<name>, they are deleted with
+// the preview, at the latest once TTL passed since it was put.
+type Preview struct {
+	Name      string
+	Route     string
+	VHost     string
+	Header    string
+	Cookie    string
+	Value     string
+	Endpoints EndpointsMap
+	TTL       string
+	Expires   time.Time
+}
+
+// resource names the cluster and the rule of the preview.
+func (p *Preview) resource() string {
+	return "preview-" + p.Name
+}
+
+func (p *Preview) expired(now time.Time) bool {
+	return !p.Expires.IsZero() && !now.Before(p.Expires)
+}
+
+func (p *Preview) rule() *RouteRule {
+	rule := &RouteRule{Name: p.resource(), Cluster: p.resource()}
+	if p.Cookie != "" {
+		cookie := regexp.QuoteMeta(p.Cookie + "=" + p.Value)
+		rule.Headers = []HeaderMatch{{Name: "cookie", Regex: `(.*;\s*)?` + cookie + `(;.*)?`}}
+	} else {
+		rule.Headers = []HeaderMatch{{Name: p.Header, Exact: p.Value}}
+	}
+	return rule
+}
+
+func (p *Preview) check() error {
+	if p.Route == "" {
+		return errors.New("Preview needs a Route")
+	}
+	if p.Header != "" && p.Cookie != "" {
+		return errors.New("Preview can only match one of Header and Cookie")
+	}
+	if p.Header == "" && p.Cookie == "" {
+		p.Header = previewHeader
+	}
+	if p.Value == "" {
+		p.Value = p.Name
+	}
+	if p.TTL != "" {
+		if d, err := time.ParseDuration(p.TTL); err != nil || d <= 0 {
+			return fmt.Errorf("Preview TTL %q is not a positive duration", p.TTL)
+		}
+	}
+	for name, e := range p.Endpoints {
+		if e == nil || e.UpstreamHost == "" || e.UpstreamPort == 0 {
+			return fmt.Errorf("Preview endpoint %s needs an UpstreamHost and an UpstreamPort", name)
+		}
+		if e.State == "" {
+			e.State = StateEnabled
+		}
+	}
+	return nil
+}
+
+// PutPreview creates or replaces a preview, its TTL starts over. Expires is
+// set before the operation is logged so replaying it keeps the same expiry.
+func (cf Configuration) PutPreview(p *Preview) error {
+	p.Expires = time.Time{}
+	if d, err := time.ParseDuration(p.TTL); err == nil && d > 0 {
+		p.Expires = time.Now().Add(d)
+	}
+	return cf.Execute(Operation{Op: OpPutPreview, Name: p.Name, Preview: p})
+}
+
+func (cf Configuration) DeletePreview(name string) error {
+	return cf.Execute(Operation{Op: OpDeletePreview, Name: name})
+}
+
+// putPreview creates or replaces a preview with its cluster and rule, it
+// expires at Expires.
+func (cf Configuration) putPreview(p *Preview) error {
+	if p == nil || p.Name == "" {
+		return errors.New("Preview name is required")
+	}
+	if err := p.check(); err != nil {
+		return err
+	}
+	r, ok := cf.RouteConf[p.Route]
+	if !ok {
+		return fmt.Errorf("Route %s %w", p.Route, ErrNotFound)
+	}
+	if old, ok := cf.Previews[p.Name]; ok {
+		cf.removePreview(old)
+	} else if _, ok := cf.Clusters[p.resource()]; ok {
+		return fmt.Errorf("Cluster %s already exists", p.resource())
+	}
+
+	endpoints := make(EndpointsMap, len(p.Endpoints))
+	for name, e := range p.Endpoints {
+		copied := *e
+		endpoints[name] = &copied
+	}
+	c := &Cluster{Name: p.resource(), Endpoints: endpoints, Groups: r.Groups}
+	if err := cf.checkCluster(c); err != nil {
+		return err
+	}
+	cf.Clusters[c.Name] = c
+	rules := []*RouteRule{p.rule()}
+	if p.VHost != "" {
+		vh, err := cf.vhost(p.Route, p.VHost)
+		if err != nil {
+			return err
+		}
+		vh.Routes = append(rules, vh.Routes...)
+		if err := vh.check(); err != nil {
+			return err
+		}
+	} else {
+		r.Rules = append(rules, r.Rules...)
+		if err := checkRules("Route "+r.Name, r.Rules); err != nil {
+			return err
+		}
+		if err := r.checkDomains(); err != nil {
+			return err
+		}
+	}
+
+	if p.TTL != "" && p.Expires.IsZero() {
+		// logged before the expiry was part of the operation
+		d, _ := time.ParseDuration(p.TTL)
+		p.Expires = time.Now().Add(d)
+	}
+	cf.Previews[p.Name] = p
+	return nil
+}
+
+func (cf Configuration) deletePreview(name string) error {
+	p, ok := cf.Previews[name]
+	if !ok {
+		return fmt.Errorf("Preview %s %w", name, ErrNotFound)
+	}
+	cf.removePreview(p)
+	return nil
+}
+
+// removePreview deletes a preview with its rule and cluster, whatever is
+// left of them.
+func (cf Configuration) removePreview(p *Preview) {
+	if r, ok := cf.RouteConf[p.Route]; ok {
+		r.Rules = withoutRule(r.Rules, p.resource())
+		if vh, ok := r.VirtualHosts[p.VHost]; ok {
+			vh.Routes = withoutRule(vh.Routes, p.resource())
+		}
+	}
+	if _, ok := cf.Clusters[p.resource()]; ok {
+		_ = cf.deleteCluster(p.resource(), true)
+	}
+	delete(cf.Previews, p.Name)
+}
+
+func withoutRule(rules []*RouteRule, name string) []*RouteRule {
+	for i, rule := range rules {
+		if rule.Name == name {
+			return append(rules[:i:i], rules[i+1:]...)
+		}
+	}
+	return rules
+}
+
+// ReapPreviews deletes the previews whose TTL passed, checking every tick.
+func ReapPreviews(cf Configuration, tick time.Duration) {
+	for now := range time.Tick(tick) {
+		var expired []string
+		cf.mu.RLock()
+		for _, p := range cf.Previews {
+			if p.expired(now) {
+				expired = append(expired, p.Name)
+			}
+		}
+		cf.mu.RUnlock()
+
+		for _, name := range expired {
+			if err := cf.DeletePreview(name); err != nil {
+				Log.Errorf("preview %s: expiry failed: %s", name, err)
+				continue
+			}
+			Log.Infof("preview %s expired", name)
+		}
+	}
+}
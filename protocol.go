@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const ProtocolHTTP1 = "http1"
+const ProtocolHTTP2 = "http2"
+const ProtocolAuto = "auto"
+
+// httpProtocolOptions is the extension the upstream protocol options of a
+// cluster are given to.
+const httpProtocolOptions = "envoy.extensions.upstreams.http.v3.HttpProtocolOptions"
+
+// defaultConnectTimeout is the connect timeout of clusters setting none.
+const defaultConnectTimeout = 5 * time.Second
+
+// checkProtocol validates the upstream connection options of a cluster,
+// auto picks HTTP/1 or HTTP/2 by ALPN, so it needs TLS to the upstream.
+func (c *Cluster) checkProtocol() error {
+	c.Protocol = strings.ToLower(c.Protocol)
+	switch c.Protocol {
+	case "", ProtocolHTTP1, ProtocolHTTP2, ProtocolAuto:
+	default:
+		return fmt.Errorf("Cluster %s Protocol %s is not http1, http2 or auto", c.Name, c.Protocol)
+	}
+	if c.Protocol == ProtocolAuto && c.TLS == nil {
+		return fmt.Errorf("Cluster %s Protocol auto needs TLS to negotiate by ALPN", c.Name)
+	}
+	if c.ConnectTimeout != "" {
+		if d, err := time.ParseDuration(c.ConnectTimeout); err != nil || d <= 0 {
+			return fmt.Errorf("Cluster %s ConnectTimeout %q is not a positive duration", c.Name, c.ConnectTimeout)
+		}
+	}
+	if err := checkDuration("IdleTimeout", c.IdleTimeout); err != nil {
+		return fmt.Errorf("Cluster %s %s", c.Name, err)
+	}
+	return nil
+}
+
+// hasProtocolOptions reports whether the cluster sets any HTTP protocol
+// option, Envoy defaults to HTTP/1.1 otherwise.
+func (c *Cluster) hasProtocolOptions() bool {
+	return c.Protocol != "" || c.IdleTimeout != ""
+}
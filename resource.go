@@ -14,10 +14,16 @@
 package main
 
 import (
-	"strconv"
+	"encoding/hex"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/golang/protobuf/ptypes/duration"
+	"github.com/golang/protobuf/ptypes/wrappers"
 
 	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
@@ -25,21 +31,255 @@ import (
 	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
 	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
 	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	omitcanary "github.com/envoyproxy/go-control-plane/envoy/extensions/retry/host/omit_canary_hosts/v3"
+	previoushosts "github.com/envoyproxy/go-control-plane/envoy/extensions/retry/host/previous_hosts/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	upstreamhttp "github.com/envoyproxy/go-control-plane/envoy/extensions/upstreams/http/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
 	v3types "github.com/envoyproxy/go-control-plane/envoy/type/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
 )
 
-func makeCluster(clusterName string) *cluster.Cluster {
-	return &cluster.Cluster{
-		Name:                 clusterName,
-		ConnectTimeout:       ptypes.DurationProto(5 * time.Second),
+func makeCluster(c *Cluster) *cluster.Cluster {
+	cl := &cluster.Cluster{
+		Name:                 c.Name,
+		ConnectTimeout:       ptypes.DurationProto(defaultConnectTimeout),
 		ClusterDiscoveryType: &cluster.Cluster_Type{Type: cluster.Cluster_EDS},
-		LbPolicy:             cluster.Cluster_ROUND_ROBIN,
+		LbPolicy:             cluster.Cluster_LbPolicy(cluster.Cluster_LbPolicy_value[c.LbPolicy]),
 		//LoadAssignment:       makeEndpoint(clusterName),
 		DnsLookupFamily:  cluster.Cluster_V4_ONLY,
 		EdsClusterConfig: makeEDSCluster(),
 	}
+	cl.PerConnectionBufferLimitBytes = makeUInt32(c.PerConnectionBufferLimit)
+	cl.MaxRequestsPerConnection = makeUInt32(c.MaxRequestsPerConnection)
+	if c.ConnectTimeout != "" {
+		cl.ConnectTimeout = makeDuration(c.ConnectTimeout)
+	}
+	if c.hasProtocolOptions() {
+		options, err := ptypes.MarshalAny(makeProtocolOptions(c))
+		if err != nil {
+			panic(err)
+		}
+		cl.TypedExtensionProtocolOptions = map[string]*any.Any{httpProtocolOptions: options}
+	}
+	if c.TLS != nil {
+		cl.TransportSocket = makeUpstreamTLS(c)
+	}
+	if c.RingHash != nil {
+		config := &cluster.Cluster_RingHashLbConfig{
+			HashFunction: cluster.Cluster_RingHashLbConfig_HashFunction(
+				cluster.Cluster_RingHashLbConfig_HashFunction_value[c.RingHash.HashFunction]),
+		}
+		if c.RingHash.MinimumRingSize != 0 {
+			config.MinimumRingSize = &wrappers.UInt64Value{Value: c.RingHash.MinimumRingSize}
+		}
+		if c.RingHash.MaximumRingSize != 0 {
+			config.MaximumRingSize = &wrappers.UInt64Value{Value: c.RingHash.MaximumRingSize}
+		}
+		cl.LbConfig = &cluster.Cluster_RingHashLbConfig_{RingHashLbConfig: config}
+	}
+	if c.Maglev != nil && c.Maglev.TableSize != 0 {
+		cl.LbConfig = &cluster.Cluster_MaglevLbConfig_{
+			MaglevLbConfig: &cluster.Cluster_MaglevLbConfig{
+				TableSize: &wrappers.UInt64Value{Value: c.Maglev.TableSize},
+			},
+		}
+	}
+	for _, hc := range c.HealthChecks {
+		cl.HealthChecks = append(cl.HealthChecks, makeHealthCheck(hc, c.Protocol))
+	}
+	if c.OutlierDetection != nil {
+		cl.OutlierDetection = makeOutlierDetection(c.OutlierDetection)
+	}
+	if len(c.CircuitBreakers) > 0 {
+		cl.CircuitBreakers = makeCircuitBreakers(c.CircuitBreakers)
+	}
+	return cl
+}
+
+func makeProtocolOptions(c *Cluster) *upstreamhttp.HttpProtocolOptions {
+	options := &upstreamhttp.HttpProtocolOptions{}
+	if c.IdleTimeout != "" {
+		options.CommonHttpProtocolOptions = &core.HttpProtocolOptions{IdleTimeout: makeDuration(c.IdleTimeout)}
+	}
+	switch c.Protocol {
+	case ProtocolHTTP2:
+		options.UpstreamProtocolOptions = &upstreamhttp.HttpProtocolOptions_ExplicitHttpConfig_{
+			ExplicitHttpConfig: &upstreamhttp.HttpProtocolOptions_ExplicitHttpConfig{
+				ProtocolConfig: &upstreamhttp.HttpProtocolOptions_ExplicitHttpConfig_Http2ProtocolOptions{
+					Http2ProtocolOptions: &core.Http2ProtocolOptions{},
+				},
+			},
+		}
+	case ProtocolAuto:
+		options.UpstreamProtocolOptions = &upstreamhttp.HttpProtocolOptions_AutoConfig{
+			AutoConfig: &upstreamhttp.HttpProtocolOptions_AutoHttpConfig{
+				HttpProtocolOptions:  &core.Http1ProtocolOptions{},
+				Http2ProtocolOptions: &core.Http2ProtocolOptions{},
+			},
+		}
+	default:
+		options.UpstreamProtocolOptions = &upstreamhttp.HttpProtocolOptions_ExplicitHttpConfig_{
+			ExplicitHttpConfig: &upstreamhttp.HttpProtocolOptions_ExplicitHttpConfig{
+				ProtocolConfig: &upstreamhttp.HttpProtocolOptions_ExplicitHttpConfig_HttpProtocolOptions{
+					HttpProtocolOptions: &core.Http1ProtocolOptions{},
+				},
+			},
+		}
+	}
+	return options
+}
+
+// makeUpstreamTLS fetches the certificates of a cluster over SDS, ALPN
+// offers the protocols the cluster may use.
+func makeUpstreamTLS(c *Cluster) *core.TransportSocket {
+	common := &tlsv3.CommonTlsContext{}
+	switch c.Protocol {
+	case ProtocolHTTP2:
+		common.AlpnProtocols = []string{"h2"}
+	case ProtocolAuto:
+		common.AlpnProtocols = []string{"h2", "http/1.1"}
+	}
+	if c.TLS.ClientSecret != "" {
+		common.TlsCertificateSdsSecretConfigs = []*tlsv3.SdsSecretConfig{{
+			Name:      c.TLS.ClientSecret,
+			SdsConfig: makeConfigSource(),
+		}}
+	}
+	if c.TLS.CASecret != "" {
+		ca := &tlsv3.SdsSecretConfig{Name: c.TLS.CASecret, SdsConfig: makeConfigSource()}
+		if len(c.TLS.VerifySAN) > 0 {
+			var sans []*matcher.StringMatcher
+			for _, san := range c.TLS.VerifySAN {
+				sans = append(sans, &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_Exact{Exact: san}})
+			}
+			common.ValidationContextType = &tlsv3.CommonTlsContext_CombinedValidationContext{
+				CombinedValidationContext: &tlsv3.CommonTlsContext_CombinedCertificateValidationContext{
+					DefaultValidationContext:         &tlsv3.CertificateValidationContext{MatchSubjectAltNames: sans},
+					ValidationContextSdsSecretConfig: ca,
+				},
+			}
+		} else {
+			common.ValidationContextType = &tlsv3.CommonTlsContext_ValidationContextSdsSecretConfig{
+				ValidationContextSdsSecretConfig: ca,
+			}
+		}
+	}
+	typed, err := ptypes.MarshalAny(&tlsv3.UpstreamTlsContext{Sni: c.TLS.SNI, CommonTlsContext: common})
+	if err != nil {
+		panic(err)
+	}
+	return &core.TransportSocket{
+		Name:       wellknown.TransportSocketTls,
+		ConfigType: &core.TransportSocket_TypedConfig{TypedConfig: typed},
+	}
+}
+
+func makeSecret(s *Secret) *tlsv3.Secret {
+	if s.TrustedCA != "" {
+		return &tlsv3.Secret{
+			Name: s.Name,
+			Type: &tlsv3.Secret_ValidationContext{
+				ValidationContext: &tlsv3.CertificateValidationContext{
+					TrustedCa: makeDataSource(s.TrustedCA),
+				},
+			},
+		}
+	}
+	return &tlsv3.Secret{
+		Name: s.Name,
+		Type: &tlsv3.Secret_TlsCertificate{
+			TlsCertificate: &tlsv3.TlsCertificate{
+				CertificateChain: makeDataSource(s.CertificateChain),
+				PrivateKey:       makeDataSource(s.PrivateKey),
+			},
+		},
+	}
+}
+
+func makeDataSource(pem string) *core.DataSource {
+	return &core.DataSource{Specifier: &core.DataSource_InlineString{InlineString: pem}}
+}
+
+func makeOutlierDetection(od *OutlierDetection) *cluster.OutlierDetection {
+	detection := &cluster.OutlierDetection{
+		Consecutive_5Xx:    makeUInt32(od.Consecutive5xx),
+		Interval:           makeDuration(od.Interval),
+		BaseEjectionTime:   makeDuration(od.BaseEjectionTime),
+		MaxEjectionPercent: makeUInt32(od.MaxEjectionPercent),
+	}
+	if od.ConsecutiveGatewayFailure != 0 {
+		detection.ConsecutiveGatewayFailure = makeUInt32(od.ConsecutiveGatewayFailure)
+		detection.EnforcingConsecutiveGatewayFailure = &wrappers.UInt32Value{Value: 100}
+	}
+	return detection
+}
+
+func makeCircuitBreakers(cb CircuitBreakers) *cluster.CircuitBreakers {
+	breakers := &cluster.CircuitBreakers{}
+	for _, priority := range cb.priorities() {
+		t := cb[priority]
+		breakers.Thresholds = append(breakers.Thresholds, &cluster.CircuitBreakers_Thresholds{
+			Priority:           core.RoutingPriority(core.RoutingPriority_value[strings.ToUpper(priority)]),
+			MaxConnections:     makeUInt32(t.MaxConnections),
+			MaxPendingRequests: makeUInt32(t.MaxPendingRequests),
+			MaxRequests:        makeUInt32(t.MaxRequests),
+			MaxRetries:         makeUInt32(t.MaxRetries),
+		})
+	}
+	return breakers
+}
+
+// makeUInt32 leaves the values that are not set to Envoy.
+func makeUInt32(value uint32) *wrappers.UInt32Value {
+	if value == 0 {
+		return nil
+	}
+	return &wrappers.UInt32Value{Value: value}
+}
+
+// makeHealthCheck probes HTTP/2 clusters over HTTP/2.
+func makeHealthCheck(hc *HealthCheck, protocol string) *core.HealthCheck {
+	check := &core.HealthCheck{
+		Timeout:            makeDuration(hc.Timeout),
+		Interval:           makeDuration(hc.Interval),
+		HealthyThreshold:   &wrappers.UInt32Value{Value: hc.HealthyThreshold},
+		UnhealthyThreshold: &wrappers.UInt32Value{Value: hc.UnhealthyThreshold},
+	}
+	switch hc.Type {
+	case HealthCheckHTTP:
+		probe := &core.HealthCheck_HttpHealthCheck{Host: hc.Host, Path: hc.Path}
+		if protocol == ProtocolHTTP2 {
+			probe.CodecClientType = v3types.CodecClientType_HTTP2
+		}
+		for _, s := range hc.ExpectedStatuses {
+			r, _ := parseStatusRange(s)
+			probe.ExpectedStatuses = append(probe.ExpectedStatuses, &v3types.Int64Range{Start: r.start, End: r.end})
+		}
+		check.HealthChecker = &core.HealthCheck_HttpHealthCheck_{HttpHealthCheck: probe}
+	case HealthCheckTCP:
+		probe := &core.HealthCheck_TcpHealthCheck{}
+		if hc.Send != "" {
+			probe.Send = makePayload(hc.Send)
+		}
+		if hc.Receive != "" {
+			probe.Receive = []*core.HealthCheck_Payload{makePayload(hc.Receive)}
+		}
+		check.HealthChecker = &core.HealthCheck_TcpHealthCheck_{TcpHealthCheck: probe}
+	case HealthCheckGRPC:
+		check.HealthChecker = &core.HealthCheck_GrpcHealthCheck_{
+			GrpcHealthCheck: &core.HealthCheck_GrpcHealthCheck{ServiceName: hc.ServiceName},
+		}
+	}
+	return check
+}
+
+// makePayload sends text as is, Envoy takes it hex encoded.
+func makePayload(text string) *core.HealthCheck_Payload {
+	return &core.HealthCheck_Payload{
+		Payload: &core.HealthCheck_Payload_Text{Text: hex.EncodeToString([]byte(text))},
+	}
 }
 
 func makeEDSCluster() *cluster.Cluster_EdsClusterConfig {
@@ -81,27 +321,152 @@ func makeEndpoint(cl *Cluster) *endpoint.ClusterLoadAssignment {
 	}
 }
 
-func makeRoute(routeName string, clusterName string) *route.RouteConfiguration {
-	return &route.RouteConfiguration{
-		Name: routeName,
-		VirtualHosts: []*route.VirtualHost{{
-			Name:    "local_service",
+func makeRoute(r *RouteConf) *route.RouteConfiguration {
+	var vhosts []*route.VirtualHost
+	for _, name := range r.VirtualHosts.names() {
+		vhosts = append(vhosts, makeVirtualHost(r.VirtualHosts[name]))
+	}
+	if r.hasDefault() || len(r.Rules) > 0 {
+		routes := make([]*route.Route, 0, len(r.Rules)+1)
+		for _, rule := range r.Rules {
+			routes = append(routes, makeRouteRule(rule))
+		}
+		if r.hasDefault() {
+			routes = append(routes, makeRouteRule(&RouteRule{Cluster: r.Cluster, Weights: r.Weights}))
+		}
+		vhosts = append(vhosts, &route.VirtualHost{
+			Name:    defaultVHost,
 			Domains: []string{"*"},
-			Routes: []*route.Route{{
-				Match: &route.RouteMatch{
-					PathSpecifier: &route.RouteMatch_Prefix{
-						Prefix: "/",
-					},
+			Routes:  routes,
+		})
+	}
+	mirrors := makeMirrorPolicies(r)
+	retry := makeRetryPolicy(r.Retry)
+	hashing := makeHashPolicies(r.HashPolicies)
+	for _, vh := range vhosts {
+		for _, rt := range vh.Routes {
+			action := rt.GetRoute()
+			action.RequestMirrorPolicies = mirrors
+			action.Timeout = makeDuration(r.Timeout)
+			action.IdleTimeout = makeDuration(r.IdleTimeout)
+			action.RetryPolicy = retry
+			action.HashPolicy = hashing
+		}
+	}
+	return &route.RouteConfiguration{
+		Name:         r.Name,
+		VirtualHosts: vhosts,
+	}
+}
+
+func makeVirtualHost(vh *VHost) *route.VirtualHost {
+	routes := make([]*route.Route, 0, len(vh.Routes))
+	for _, rule := range vh.Routes {
+		routes = append(routes, makeRouteRule(rule))
+	}
+	return &route.VirtualHost{
+		Name:    vh.Name,
+		Domains: vh.Domains,
+		Routes:  routes,
+	}
+}
+
+func makeRouteRule(rule *RouteRule) *route.Route {
+	return &route.Route{
+		Name:  rule.Name,
+		Match: makeRouteMatch(rule),
+		Action: &route.Route_Route{
+			Route: makeRouteAction(rule),
+		},
+	}
+}
+
+func makeRouteAction(rule *RouteRule) *route.RouteAction {
+	if len(rule.Weights) == 0 {
+		return &route.RouteAction{
+			ClusterSpecifier: &route.RouteAction_Cluster{
+				Cluster: rule.Cluster,
+			},
+		}
+	}
+	var total uint32
+	var clusters []*route.WeightedCluster_ClusterWeight
+	for _, name := range rule.Weights.names() {
+		total += rule.Weights[name]
+		clusters = append(clusters, &route.WeightedCluster_ClusterWeight{
+			Name:   name,
+			Weight: &wrappers.UInt32Value{Value: rule.Weights[name]},
+		})
+	}
+	return &route.RouteAction{
+		ClusterSpecifier: &route.RouteAction_WeightedClusters{
+			WeightedClusters: &route.WeightedCluster{
+				Clusters:    clusters,
+				TotalWeight: &wrappers.UInt32Value{Value: total},
+			},
+		},
+	}
+}
+
+func makeRouteMatch(rule *RouteRule) *route.RouteMatch {
+	match := &route.RouteMatch{}
+	switch {
+	case rule.Path != "":
+		match.PathSpecifier = &route.RouteMatch_Path{Path: rule.Path}
+	case rule.Regex != "":
+		match.PathSpecifier = &route.RouteMatch_SafeRegex{SafeRegex: makeRegexMatcher(rule.Regex)}
+	case rule.Prefix != "":
+		match.PathSpecifier = &route.RouteMatch_Prefix{Prefix: rule.Prefix}
+	default:
+		match.PathSpecifier = &route.RouteMatch_Prefix{Prefix: "/"}
+	}
+
+	if rule.Method != "" {
+		match.Headers = append(match.Headers, &route.HeaderMatcher{
+			Name:                 ":method",
+			HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{ExactMatch: rule.Method},
+		})
+	}
+	for _, h := range rule.Headers {
+		m := &route.HeaderMatcher{Name: h.Name, InvertMatch: h.Invert}
+		switch {
+		case h.Present:
+			m.HeaderMatchSpecifier = &route.HeaderMatcher_PresentMatch{PresentMatch: true}
+		case h.Regex != "":
+			m.HeaderMatchSpecifier = &route.HeaderMatcher_SafeRegexMatch{SafeRegexMatch: makeRegexMatcher(h.Regex)}
+		default:
+			m.HeaderMatchSpecifier = &route.HeaderMatcher_ExactMatch{ExactMatch: h.Exact}
+		}
+		match.Headers = append(match.Headers, m)
+	}
+
+	for _, q := range rule.Query {
+		m := &route.QueryParameterMatcher{Name: q.Name}
+		switch {
+		case q.Present:
+			m.QueryParameterMatchSpecifier = &route.QueryParameterMatcher_PresentMatch{PresentMatch: true}
+		case q.Regex != "":
+			m.QueryParameterMatchSpecifier = &route.QueryParameterMatcher_StringMatch{
+				StringMatch: &matcher.StringMatcher{
+					MatchPattern: &matcher.StringMatcher_SafeRegex{SafeRegex: makeRegexMatcher(q.Regex)},
 				},
-				Action: &route.Route_Route{
-					Route: &route.RouteAction{
-						ClusterSpecifier: &route.RouteAction_Cluster{
-							Cluster: clusterName,
-						},
-					},
+			}
+		default:
+			m.QueryParameterMatchSpecifier = &route.QueryParameterMatcher_StringMatch{
+				StringMatch: &matcher.StringMatcher{
+					MatchPattern: &matcher.StringMatcher_Exact{Exact: q.Exact},
 				},
-			}},
-		}},
+			}
+		}
+		match.QueryParameters = append(match.QueryParameters, m)
+	}
+	return match
+}
+
+func makeRegexMatcher(regex string) *matcher.RegexMatcher {
+	return &matcher.RegexMatcher{
+		EngineType: &matcher.RegexMatcher_GoogleRe2{GoogleRe2: &matcher.RegexMatcher_GoogleRE2{}},
+		Regex:      regex,
 	}
 }
 
@@ -167,16 +532,98 @@ func makeConfigSource() *core.ConfigSource {
 	return source
 }
 
-func makeMirroringConfig(cluster string, fraction uint32) []*route.RouteAction_RequestMirrorPolicy {
-	return []*route.RouteAction_RequestMirrorPolicy{
-		{
-			Cluster: cluster,
+func makeRetryPolicy(p *RetryPolicy) *route.RetryPolicy {
+	if p == nil {
+		return nil
+	}
+	policy := &route.RetryPolicy{
+		RetryOn:              strings.Join(p.RetryOn, ","),
+		NumRetries:           makeUInt32(p.NumRetries),
+		PerTryTimeout:        makeDuration(p.PerTryTimeout),
+		RetriableStatusCodes: p.RetriableStatusCodes,
+	}
+	for _, name := range p.RetryHostPredicates {
+		var config proto.Message
+		switch name {
+		case "previous_hosts":
+			config = &previoushosts.PreviousHostsPredicate{}
+		case "omit_canary_hosts":
+			config = &omitcanary.OmitCanaryHostsPredicate{}
+		}
+		typed, err := ptypes.MarshalAny(config)
+		if err != nil {
+			panic(err)
+		}
+		policy.RetryHostPredicate = append(policy.RetryHostPredicate, &route.RetryPolicy_RetryHostPredicate{
+			Name:       retryHostPredicates[name],
+			ConfigType: &route.RetryPolicy_RetryHostPredicate_TypedConfig{TypedConfig: typed},
+		})
+	}
+	return policy
+}
+
+func makeHashPolicies(policies []HashPolicy) []*route.RouteAction_HashPolicy {
+	var hashing []*route.RouteAction_HashPolicy
+	for _, h := range policies {
+		policy := &route.RouteAction_HashPolicy{Terminal: h.Terminal}
+		switch {
+		case h.Header != "":
+			policy.PolicySpecifier = &route.RouteAction_HashPolicy_Header_{
+				Header: &route.RouteAction_HashPolicy_Header{HeaderName: h.Header},
+			}
+		case h.Cookie != "":
+			policy.PolicySpecifier = &route.RouteAction_HashPolicy_Cookie_{
+				Cookie: &route.RouteAction_HashPolicy_Cookie{
+					Name: h.Cookie,
+					Ttl:  makeDuration(h.CookieTTL),
+					Path: h.CookiePath,
+				},
+			}
+		case h.SourceIP:
+			policy.PolicySpecifier = &route.RouteAction_HashPolicy_ConnectionProperties_{
+				ConnectionProperties: &route.RouteAction_HashPolicy_ConnectionProperties{SourceIp: true},
+			}
+		default:
+			policy.PolicySpecifier = &route.RouteAction_HashPolicy_QueryParameter_{
+				QueryParameter: &route.RouteAction_HashPolicy_QueryParameter{Name: h.QueryParameter},
+			}
+		}
+		hashing = append(hashing, policy)
+	}
+	return hashing
+}
+
+// makeDuration leaves durations that are not set to Envoy.
+func makeDuration(value string) *duration.Duration {
+	if value == "" {
+		return nil
+	}
+	d, _ := time.ParseDuration(value)
+	return ptypes.DurationProto(d)
+}
+
+// makeMirrorPolicies mirrors the requests of a route to all its mirrors,
+// sorted by cluster so the config stays the same between snapshots.
+func makeMirrorPolicies(r *RouteConf) []*route.RouteAction_RequestMirrorPolicy {
+	clusters := make([]string, 0, len(r.Mirroring))
+	for name := range r.Mirroring {
+		clusters = append(clusters, name)
+	}
+	sort.Strings(clusters)
+
+	var policies []*route.RouteAction_RequestMirrorPolicy
+	for _, name := range clusters {
+		m := r.Mirroring[name]
+		policies = append(policies, &route.RouteAction_RequestMirrorPolicy{
+			Cluster: name,
 			RuntimeFraction: &core.RuntimeFractionalPercent{
 				DefaultValue: &v3types.FractionalPercent{
-					Numerator: fraction,
+					Numerator:   m.Numerator,
+					Denominator: m.denominator(),
 				},
-				RuntimeKey: strconv.Itoa(int(fraction)),
+				RuntimeKey: m.runtimeKey(r.Name, name),
 			},
-		},
+		})
 	}
+	return policies
 }
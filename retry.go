@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// RetryPolicy retries the requests of a route failing with one of the
+// RetryOn conditions up to NumRetries times, each try taking at most
+// PerTryTimeout. RetriableStatusCodes apply with the retriable-status-codes
+// condition, RetryHostPredicates (previous_hosts, omit_canary_hosts) pick
+// the hosts of the next tries.
+type RetryPolicy struct {
+	RetryOn              []string
+	NumRetries           uint32
+	PerTryTimeout        string
+	RetriableStatusCodes []uint32
+	RetryHostPredicates  []string
+}
+
+// retryConditions are the retry-on conditions Envoy understands, for HTTP
+// and gRPC.
+var retryConditions = map[string]bool{
+	"5xx":                        true,
+	"gateway-error":              true,
+	"reset":                      true,
+	"connect-failure":            true,
+	"envoy-ratelimited":          true,
+	"retriable-4xx":              true,
+	"refused-stream":             true,
+	"retriable-status-codes":     true,
+	"retriable-headers":          true,
+	"http3-post-connect-failure": true,
+	"cancelled":                  true,
+	"deadline-exceeded":          true,
+	"internal":                   true,
+	"resource-exhausted":         true,
+	"unavailable":                true,
+}
+
+// retryHostPredicates maps the predicate names to their Envoy extension.
+var retryHostPredicates = map[string]string{
+	"previous_hosts":    "envoy.retry_host_predicates.previous_hosts",
+	"omit_canary_hosts": "envoy.retry_host_predicates.omit_canary_hosts",
+}
+
+func (p *RetryPolicy) check() error {
+	if len(p.RetryOn) == 0 {
+		return errors.New("retry policy needs RetryOn conditions")
+	}
+	for _, on := range p.RetryOn {
+		if !retryConditions[on] {
+			return fmt.Errorf("retry condition %q is unknown", on)
+		}
+	}
+	if err := checkDuration("retry PerTryTimeout", p.PerTryTimeout); err != nil {
+		return err
+	}
+	for _, code := range p.RetriableStatusCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("retriable status code %d is not an HTTP status", code)
+		}
+	}
+	for _, name := range p.RetryHostPredicates {
+		if _, ok := retryHostPredicates[name]; !ok {
+			return fmt.Errorf("retry host predicate %q is not previous_hosts or omit_canary_hosts", name)
+		}
+	}
+	return nil
+}
+
+// checkPolicies validates the timeouts, the retry and the hash policies of a
+// route.
+func (r *RouteConf) checkPolicies() error {
+	if err := checkDuration("Timeout", r.Timeout); err != nil {
+		return fmt.Errorf("Route %s %s", r.Name, err)
+	}
+	if err := checkDuration("IdleTimeout", r.IdleTimeout); err != nil {
+		return fmt.Errorf("Route %s %s", r.Name, err)
+	}
+	if r.Retry != nil {
+		if err := r.Retry.check(); err != nil {
+			return fmt.Errorf("Route %s %s", r.Name, err)
+		}
+	}
+	for _, h := range r.HashPolicies {
+		if err := h.check(); err != nil {
+			return fmt.Errorf("Route %s %s", r.Name, err)
+		}
+	}
+	return nil
+}
+
+// checkDuration accepts an empty value, for the Envoy default, and 0s to
+// disable the timeout.
+func checkDuration(name, value string) error {
+	if value == "" {
+		return nil
+	}
+	if d, err := time.ParseDuration(value); err != nil || d < 0 {
+		return fmt.Errorf("%s %q is not a duration", name, value)
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const RolloutRunning = "running"
+const RolloutPaused = "paused"
+const RolloutAborted = "aborted"
+const RolloutCompleted = "completed"
+
+// gateRetry is how long a rollout waits after its metric gate could not be
+// evaluated.
+const gateRetry = 10 * time.Second
+
+type RolloutsMap map[string]*Rollout
+
+// Rollout shifts the default traffic of Route from Stable to Canary. Steps
+// are the canary weights in percent, the next one is taken every Interval
+// while Query, if set, stays at or below Max.
+type Rollout struct {
+	Name        string
+	Route       string
+	Stable      string
+	Canary      string
+	Steps       []uint32
+	Interval    string
+	Query       string
+	Max         float64
+	State       string
+	Step        int
+	StepStarted time.Time
+	Message     string
+}
+
+func (ro *Rollout) interval() time.Duration {
+	d, _ := time.ParseDuration(ro.Interval)
+	return d
+}
+
+func (ro *Rollout) weights() ClusterWeights {
+	canary := ro.Steps[ro.Step]
+	return ClusterWeights{ro.Stable: 100 - canary, ro.Canary: canary}
+}
+
+func (ro *Rollout) check() error {
+	if ro.Route == "" || ro.Stable == "" || ro.Canary == "" {
+		return errors.New("Rollout needs a Route, a Stable and a Canary cluster")
+	}
+	if ro.Stable == ro.Canary {
+		return errors.New("Rollout Stable and Canary are the same cluster")
+	}
+	if len(ro.Steps) == 0 {
+		return errors.New("Rollout has no Steps")
+	}
+	for i, step := range ro.Steps {
+		if step > 100 {
+			return fmt.Errorf("Rollout step %d is more than 100%%", step)
+		}
+		if i > 0 && step <= ro.Steps[i-1] {
+			return errors.New("Rollout Steps must increase")
+		}
+	}
+	if d, err := time.ParseDuration(ro.Interval); err != nil || d < time.Second {
+		return fmt.Errorf("Rollout Interval %q is not a duration of at least 1s", ro.Interval)
+	}
+	return nil
+}
+
+// PutRollout creates or restarts a rollout. The step timers start before
+// the operation is logged, so replaying it keeps them.
+func (cf Configuration) PutRollout(ro *Rollout) error {
+	ro.StepStarted = time.Now()
+	return cf.Execute(Operation{Op: OpPutRollout, Name: ro.Name, Rollout: ro})
+}
+
+func (cf Configuration) DeleteRollout(name string) error {
+	return cf.Execute(Operation{Op: OpDeleteRollout, Name: name})
+}
+
+// StepRollout moves a running rollout to step, which must be the next one.
+func (cf Configuration) StepRollout(name string, step int) error {
+	now := time.Now()
+	return cf.Execute(Operation{Op: OpStepRollout, Name: name, Step: step, At: &now})
+}
+
+func (cf Configuration) PauseRollout(name string) error {
+	return cf.Execute(Operation{Op: OpPauseRollout, Name: name})
+}
+
+func (cf Configuration) ResumeRollout(name string) error {
+	now := time.Now()
+	return cf.Execute(Operation{Op: OpResumeRollout, Name: name, At: &now})
+}
+
+// AbortRollout sends all the traffic back to the stable cluster.
+func (cf Configuration) AbortRollout(name, reason string) error {
+	return cf.Execute(Operation{Op: OpAbortRollout, Name: name, Reason: reason})
+}
+
+// putRollout creates or restarts a rollout at its first step.
+func (cf Configuration) putRollout(ro *Rollout) error {
+	if ro == nil || ro.Name == "" {
+		return errors.New("Rollout name is required")
+	}
+	if err := ro.check(); err != nil {
+		return err
+	}
+	if !cf.RouteOk(ro.Route) {
+		return fmt.Errorf("Route %s %w", ro.Route, ErrNotFound)
+	}
+	for _, c := range []string{ro.Stable, ro.Canary} {
+		if _, ok := cf.Clusters[c]; !ok {
+			return fmt.Errorf("Cluster %s %w", c, ErrNotFound)
+		}
+	}
+	for _, other := range cf.Rollouts {
+		if other.Name != ro.Name && other.Route == ro.Route && other.active() {
+			return fmt.Errorf("Route %s is already rolled out by %s", ro.Route, other.Name)
+		}
+	}
+	for _, bg := range cf.BlueGreens {
+		if bg.Route == ro.Route {
+			return fmt.Errorf("Route %s is switched by %s", ro.Route, bg.Name)
+		}
+	}
+	ro.State = RolloutRunning
+	if len(ro.Steps) == 1 {
+		ro.State = RolloutCompleted
+	}
+	ro.Step = 0
+	if ro.StepStarted.IsZero() {
+		// logged before the step start was part of the operation
+		ro.StepStarted = time.Now()
+	}
+	ro.Message = ""
+	cf.Rollouts[ro.Name] = ro
+	return cf.setWeights(ro.Route, "", nil, ro.weights())
+}
+
+func (cf Configuration) deleteRollout(name string) error {
+	if _, ok := cf.Rollouts[name]; !ok {
+		return fmt.Errorf("Rollout %s %w", name, ErrNotFound)
+	}
+	delete(cf.Rollouts, name)
+	return nil
+}
+
+func (cf Configuration) rollout(name string) (*Rollout, error) {
+	ro, ok := cf.Rollouts[name]
+	if !ok {
+		return nil, fmt.Errorf("Rollout %s %w", name, ErrNotFound)
+	}
+	return ro, nil
+}
+
+func (ro *Rollout) active() bool {
+	return ro.State == RolloutRunning || ro.State == RolloutPaused
+}
+
+func (cf Configuration) stepRollout(name string, step int, at *time.Time) error {
+	ro, err := cf.rollout(name)
+	if err != nil {
+		return err
+	}
+	if ro.State != RolloutRunning {
+		return fmt.Errorf("Rollout %s is %s", name, ro.State)
+	}
+	if step != ro.Step+1 || step >= len(ro.Steps) {
+		return fmt.Errorf("Rollout %s is at step %d, not stepping to %d", name, ro.Step, step)
+	}
+	ro.Step = step
+	ro.StepStarted = startedAt(at)
+	if step == len(ro.Steps)-1 {
+		ro.State = RolloutCompleted
+	}
+	return cf.setWeights(ro.Route, "", nil, ro.weights())
+}
+
+func (cf Configuration) pauseRollout(name string) error {
+	ro, err := cf.rollout(name)
+	if err != nil {
+		return err
+	}
+	if ro.State != RolloutRunning {
+		return fmt.Errorf("Rollout %s is %s", name, ro.State)
+	}
+	ro.State = RolloutPaused
+	return nil
+}
+
+// resumeRollout waits a whole interval again before the next step.
+func (cf Configuration) resumeRollout(name string, at *time.Time) error {
+	ro, err := cf.rollout(name)
+	if err != nil {
+		return err
+	}
+	if ro.State != RolloutPaused {
+		return fmt.Errorf("Rollout %s is %s", name, ro.State)
+	}
+	ro.State = RolloutRunning
+	ro.StepStarted = startedAt(at)
+	return nil
+}
+
+// startedAt is when a logged step started, now for the operations logged
+// before it was part of them.
+func startedAt(at *time.Time) time.Time {
+	if at == nil {
+		return time.Now()
+	}
+	return *at
+}
+
+func (cf Configuration) abortRollout(name, reason string) error {
+	ro, err := cf.rollout(name)
+	if err != nil {
+		return err
+	}
+	if !ro.active() {
+		return fmt.Errorf("Rollout %s is %s", name, ro.State)
+	}
+	ro.State = RolloutAborted
+	ro.Message = reason
+	return cf.setWeights(ro.Route, "", nil, ClusterWeights{ro.Stable: 100})
+}
+
+// RolloutController takes the next step of the running rollouts once their
+// interval passed and their metric gate passes, and aborts them when it
+// does not.
+type RolloutController struct {
+	cf      Configuration
+	metrics MetricSource
+	held    map[string]time.Time
+}
+
+// NewRolloutController gates rollouts on metrics, rollouts with a query
+// are held if metrics is nil.
+func NewRolloutController(cf Configuration, metrics MetricSource) *RolloutController {
+	return &RolloutController{cf: cf, metrics: metrics, held: make(map[string]time.Time)}
+}
+
+func (rc *RolloutController) Run(tick time.Duration) {
+	for now := range time.Tick(tick) {
+		rc.reconcile(now)
+	}
+}
+
+func (rc *RolloutController) reconcile(now time.Time) {
+	var due []Rollout
+	rc.cf.mu.RLock()
+	for _, ro := range rc.cf.Rollouts {
+		if ro.State == RolloutRunning && !now.Before(ro.StepStarted.Add(ro.interval())) {
+			due = append(due, *ro)
+		}
+	}
+	rc.cf.mu.RUnlock()
+
+	for _, ro := range due {
+		if now.Before(rc.held[ro.Name]) {
+			continue
+		}
+		delete(rc.held, ro.Name)
+		rc.advance(ro, now)
+	}
+}
+
+func (rc *RolloutController) advance(ro Rollout, now time.Time) {
+	if ro.Query != "" {
+		if rc.metrics == nil {
+			Log.Warnf("rollout %s: no metrics backend to evaluate %q, holding", ro.Name, ro.Query)
+			rc.held[ro.Name] = now.Add(gateRetry)
+			return
+		}
+		value, err := rc.metrics.Query(ro.Query)
+		if err != nil {
+			Log.Warnf("rollout %s: metric gate failed to evaluate, holding: %s", ro.Name, err)
+			rc.held[ro.Name] = now.Add(gateRetry)
+			return
+		}
+		if value > ro.Max {
+			reason := fmt.Sprintf("metric gate at step %d: %g is above %g", ro.Step, value, ro.Max)
+			Log.Warnf("rollout %s aborted, %s", ro.Name, reason)
+			if err := rc.cf.AbortRollout(ro.Name, reason); err != nil {
+				Log.Errorf("rollout %s: abort failed: %s", ro.Name, err)
+			}
+			return
+		}
+	}
+	if err := rc.cf.StepRollout(ro.Name, ro.Step+1); err != nil {
+		Log.Errorf("rollout %s: step failed: %s", ro.Name, err)
+		rc.held[ro.Name] = now.Add(gateRetry)
+	}
+}
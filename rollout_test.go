@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+)
+
+const errorRate = "error_rate"
+
+// newRolloutTest returns a configuration rolling route r out from cluster s
+// to cluster c in 10, 50 and 100% steps every minute, gated on errorRate
+// staying at or below 0.05, with its controller asking metrics.
+func newRolloutTest(t *testing.T, metrics *StubSource) (Configuration, *RolloutController) {
+	t.Helper()
+	scache := cache.NewSnapshotCache(false, NewGroupHash(nodeID), Log)
+	cf := Configuration{
+		Clusters:      make(ClustersMap),
+		Listeners:     make(ListenersMap),
+		RouteConf:     make(RouteConfMap),
+		NodeGroups:    make(NodeGroupsMap),
+		Rollouts:      make(RolloutsMap),
+		BlueGreens:    make(BlueGreensMap),
+		Previews:      make(PreviewsMap),
+		Secrets:       make(SecretsMap),
+		SnapshotCache: &scache,
+		Generation:    &Generation{},
+		Hash:          NewGroupHash(nodeID),
+		mu:            new(sync.RWMutex),
+	}
+	for _, name := range []string{"s", "c"} {
+		if err := cf.PutCluster(&Cluster{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cf.PutRoute(&RouteConf{Name: "r", Cluster: "s"}); err != nil {
+		t.Fatal(err)
+	}
+	err := cf.PutRollout(&Rollout{
+		Name:     "ro",
+		Route:    "r",
+		Stable:   "s",
+		Canary:   "c",
+		Steps:    []uint32{10, 50, 100},
+		Interval: "1m",
+		Query:    errorRate,
+		Max:      0.05,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cf, NewRolloutController(cf, metrics)
+}
+
+// due returns when the current step of the rollout is over.
+func due(cf Configuration) time.Time {
+	ro := cf.Rollouts["ro"]
+	return ro.StepStarted.Add(ro.interval())
+}
+
+func expectRollout(t *testing.T, cf Configuration, state string, step int, weights ClusterWeights) {
+	t.Helper()
+	ro := cf.Rollouts["ro"]
+	if ro.State != state || ro.Step != step {
+		t.Fatalf("rollout is %s at step %d, expected %s at step %d", ro.State, ro.Step, state, step)
+	}
+	if got := cf.RouteConf["r"].Weights; !reflect.DeepEqual(got, weights) {
+		t.Fatalf("route weights are %v, expected %v", got, weights)
+	}
+}
+
+func TestRolloutSteps(t *testing.T) {
+	cf, rc := newRolloutTest(t, &StubSource{Values: map[string]float64{errorRate: 0.01}})
+	expectRollout(t, cf, RolloutRunning, 0, ClusterWeights{"s": 90, "c": 10})
+
+	rc.reconcile(due(cf).Add(-time.Second))
+	expectRollout(t, cf, RolloutRunning, 0, ClusterWeights{"s": 90, "c": 10})
+
+	rc.reconcile(due(cf))
+	expectRollout(t, cf, RolloutRunning, 1, ClusterWeights{"s": 50, "c": 50})
+
+	rc.reconcile(due(cf))
+	expectRollout(t, cf, RolloutCompleted, 2, ClusterWeights{"s": 0, "c": 100})
+}
+
+func TestRolloutHoldsOnQueryError(t *testing.T) {
+	metrics := &StubSource{Err: errors.New("metrics backend unavailable")}
+	cf, rc := newRolloutTest(t, metrics)
+
+	now := due(cf)
+	rc.reconcile(now)
+	expectRollout(t, cf, RolloutRunning, 0, ClusterWeights{"s": 90, "c": 10})
+
+	// held for gateRetry even once the gate can be evaluated again
+	metrics.Err = nil
+	rc.reconcile(now.Add(gateRetry - time.Second))
+	expectRollout(t, cf, RolloutRunning, 0, ClusterWeights{"s": 90, "c": 10})
+
+	rc.reconcile(now.Add(gateRetry))
+	expectRollout(t, cf, RolloutRunning, 1, ClusterWeights{"s": 50, "c": 50})
+}
+
+func TestRolloutAbortsAboveMax(t *testing.T) {
+	metrics := &StubSource{Values: map[string]float64{errorRate: 0.01}}
+	cf, rc := newRolloutTest(t, metrics)
+
+	rc.reconcile(due(cf))
+	expectRollout(t, cf, RolloutRunning, 1, ClusterWeights{"s": 50, "c": 50})
+
+	metrics.Values[errorRate] = 0.2
+	rc.reconcile(due(cf))
+	expectRollout(t, cf, RolloutAborted, 1, ClusterWeights{"s": 100})
+	if msg := cf.Rollouts["ro"].Message; !strings.Contains(msg, "above") {
+		t.Fatalf("abort message %q does not explain the metric gate", msg)
+	}
+
+	// aborted rollouts are left alone
+	rc.reconcile(due(cf).Add(time.Hour))
+	expectRollout(t, cf, RolloutAborted, 1, ClusterWeights{"s": 100})
+}
+
+func TestRolloutPauseResume(t *testing.T) {
+	cf, rc := newRolloutTest(t, &StubSource{})
+
+	if err := cf.PauseRollout("ro"); err != nil {
+		t.Fatal(err)
+	}
+	rc.reconcile(due(cf).Add(time.Hour))
+	expectRollout(t, cf, RolloutPaused, 0, ClusterWeights{"s": 90, "c": 10})
+
+	if err := cf.ResumeRollout("ro"); err != nil {
+		t.Fatal(err)
+	}
+	// a resumed rollout waits a whole interval again
+	if started := cf.Rollouts["ro"].StepStarted; time.Since(started) > time.Minute {
+		t.Fatalf("resumed rollout step started at %s", started)
+	}
+	rc.reconcile(due(cf).Add(-time.Second))
+	expectRollout(t, cf, RolloutRunning, 0, ClusterWeights{"s": 90, "c": 10})
+
+	rc.reconcile(due(cf))
+	expectRollout(t, cf, RolloutRunning, 1, ClusterWeights{"s": 50, "c": 50})
+
+	if err := cf.ResumeRollout("ro"); err == nil {
+		t.Fatal("resumed a running rollout")
+	}
+}
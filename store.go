@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const StoreFile = "file"
+const StoreBolt = "bolt"
+
+// State is the persistent part of Configuration.
+type State struct {
+	Seq        uint64 // last operation log entry reflected in the state
+	Version    uint64 // last snapshot version generated from the state
+	Clusters   ClustersMap
+	RouteConf  RouteConfMap
+	Listeners  ListenersMap
+	NodeGroups NodeGroupsMap
+	Rollouts   RolloutsMap
+	BlueGreens BlueGreensMap
+	Previews   PreviewsMap
+	Secrets    SecretsMap
+}
+
+func (s State) groupNames() []string {
+	names := make([]string, 0, len(s.NodeGroups))
+	for name := range s.NodeGroups {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Store keeps the last committed State so it survives restarts.
+type Store interface {
+	Load() (State, error)
+	Save(state State) error
+	Close() error
+}
+
+func NewState() State {
+	return State{
+		Clusters:   make(ClustersMap),
+		RouteConf:  make(RouteConfMap),
+		Listeners:  make(ListenersMap),
+		NodeGroups: make(NodeGroupsMap),
+		Rollouts:   make(RolloutsMap),
+		BlueGreens: make(BlueGreensMap),
+		Previews:   make(PreviewsMap),
+		Secrets:    make(SecretsMap),
+	}
+}
+
+// Copy returns a deep copy of the state.
+func (s State) Copy() (State, error) {
+	copied := NewState()
+	data, err := json.Marshal(s)
+	if err != nil {
+		return copied, err
+	}
+	err = json.Unmarshal(data, &copied)
+	return copied, err
+}
+
+// NewStore opens a store of the given kind, an empty kind disables persistence.
+func NewStore(kind, path string) (Store, error) {
+	switch kind {
+	case "":
+		return nil, nil
+	case StoreFile:
+		return &FileStore{Path: path}, nil
+	case StoreBolt:
+		return OpenBoltStore(path)
+	default:
+		return nil, fmt.Errorf("unknown store type %q, use %s/%s", kind, StoreFile, StoreBolt)
+	}
+}
+
+// FileStore keeps State as a single JSON document.
+type FileStore struct {
+	Path string
+}
+
+func (s *FileStore) Load() (State, error) {
+	state := NewState()
+	data, err := ioutil.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+func (s *FileStore) Save(state State) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.Path, data)
+}
+
+// writeFileAtomic writes to a temporary file first, so a crash never leaves
+// a torn document behind.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *FileStore) Close() error {
+	return nil
+}
+
+var (
+	boltMeta      = []byte("meta")
+	boltSeq       = []byte("seq")
+	boltVersion   = []byte("version")
+	boltClusters  = []byte("clusters")
+	boltRoutes    = []byte("routes")
+	boltListeners = []byte("listeners")
+	boltGroups    = []byte("nodegroups")
+	boltRollouts  = []byte("rollouts")
+	boltBlueGreen = []byte("bluegreens")
+	boltPreviews  = []byte("previews")
+	boltSecrets   = []byte("secrets")
+)
+
+// BoltStore keeps every resource under its own key in a bbolt database.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStore{db}, nil
+}
+
+func (s *BoltStore) Load() (State, error) {
+	state := NewState()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(boltMeta); b != nil {
+			if v := b.Get(boltSeq); v != nil {
+				state.Seq = binary.BigEndian.Uint64(v)
+			}
+			if v := b.Get(boltVersion); v != nil {
+				state.Version = binary.BigEndian.Uint64(v)
+			}
+		}
+		if err := boltLoad(tx, boltClusters, func(k string, v []byte) error {
+			c := &Cluster{}
+			state.Clusters[k] = c
+			return json.Unmarshal(v, c)
+		}); err != nil {
+			return err
+		}
+		if err := boltLoad(tx, boltRoutes, func(k string, v []byte) error {
+			r := &RouteConf{}
+			state.RouteConf[k] = r
+			return json.Unmarshal(v, r)
+		}); err != nil {
+			return err
+		}
+		if err := boltLoad(tx, boltListeners, func(k string, v []byte) error {
+			l := &Listener{}
+			state.Listeners[k] = l
+			return json.Unmarshal(v, l)
+		}); err != nil {
+			return err
+		}
+		if err := boltLoad(tx, boltGroups, func(k string, v []byte) error {
+			g := &NodeGroup{}
+			state.NodeGroups[k] = g
+			return json.Unmarshal(v, g)
+		}); err != nil {
+			return err
+		}
+		if err := boltLoad(tx, boltRollouts, func(k string, v []byte) error {
+			ro := &Rollout{}
+			state.Rollouts[k] = ro
+			return json.Unmarshal(v, ro)
+		}); err != nil {
+			return err
+		}
+		if err := boltLoad(tx, boltBlueGreen, func(k string, v []byte) error {
+			bg := &BlueGreen{}
+			state.BlueGreens[k] = bg
+			return json.Unmarshal(v, bg)
+		}); err != nil {
+			return err
+		}
+		if err := boltLoad(tx, boltPreviews, func(k string, v []byte) error {
+			p := &Preview{}
+			state.Previews[k] = p
+			return json.Unmarshal(v, p)
+		}); err != nil {
+			return err
+		}
+		return boltLoad(tx, boltSecrets, func(k string, v []byte) error {
+			s := &Secret{}
+			state.Secrets[k] = s
+			return json.Unmarshal(v, s)
+		})
+	})
+	return state, err
+}
+
+func boltLoad(tx *bolt.Tx, bucket []byte, fn func(k string, v []byte) error) error {
+	b := tx.Bucket(bucket)
+	if b == nil {
+		return nil
+	}
+	return b.ForEach(func(k, v []byte) error {
+		return fn(string(k), v)
+	})
+}
+
+func (s *BoltStore) Save(state State) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(boltMeta)
+		if err != nil {
+			return err
+		}
+		seq := make([]byte, 8)
+		binary.BigEndian.PutUint64(seq, state.Seq)
+		if err = meta.Put(boltSeq, seq); err != nil {
+			return err
+		}
+		version := make([]byte, 8)
+		binary.BigEndian.PutUint64(version, state.Version)
+		if err = meta.Put(boltVersion, version); err != nil {
+			return err
+		}
+		clusters := make(map[string]interface{}, len(state.Clusters))
+		for k, v := range state.Clusters {
+			clusters[k] = v
+		}
+		if err := boltSave(tx, boltClusters, clusters); err != nil {
+			return err
+		}
+		routes := make(map[string]interface{}, len(state.RouteConf))
+		for k, v := range state.RouteConf {
+			routes[k] = v
+		}
+		if err := boltSave(tx, boltRoutes, routes); err != nil {
+			return err
+		}
+		listeners := make(map[string]interface{}, len(state.Listeners))
+		for k, v := range state.Listeners {
+			listeners[k] = v
+		}
+		if err := boltSave(tx, boltListeners, listeners); err != nil {
+			return err
+		}
+		groups := make(map[string]interface{}, len(state.NodeGroups))
+		for k, v := range state.NodeGroups {
+			groups[k] = v
+		}
+		if err := boltSave(tx, boltGroups, groups); err != nil {
+			return err
+		}
+		rollouts := make(map[string]interface{}, len(state.Rollouts))
+		for k, v := range state.Rollouts {
+			rollouts[k] = v
+		}
+		if err := boltSave(tx, boltRollouts, rollouts); err != nil {
+			return err
+		}
+		bluegreens := make(map[string]interface{}, len(state.BlueGreens))
+		for k, v := range state.BlueGreens {
+			bluegreens[k] = v
+		}
+		if err := boltSave(tx, boltBlueGreen, bluegreens); err != nil {
+			return err
+		}
+		previews := make(map[string]interface{}, len(state.Previews))
+		for k, v := range state.Previews {
+			previews[k] = v
+		}
+		if err := boltSave(tx, boltPreviews, previews); err != nil {
+			return err
+		}
+		secrets := make(map[string]interface{}, len(state.Secrets))
+		for k, v := range state.Secrets {
+			secrets[k] = v
+		}
+		return boltSave(tx, boltSecrets, secrets)
+	})
+}
+
+// boltSave replaces the bucket content with items.
+func boltSave(tx *bolt.Tx, bucket []byte, items map[string]interface{}) error {
+	if tx.Bucket(bucket) != nil {
+		if err := tx.DeleteBucket(bucket); err != nil {
+			return err
+		}
+	}
+	b, err := tx.CreateBucket(bucket)
+	if err != nil {
+		return err
+	}
+	for k, v := range items {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if err = b.Put([]byte(k), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// redactedKey replaces the private keys the control API hands out.
+const redactedKey = "<redacted>"
+
+type SecretsMap map[string]*Secret
+
+// Secret is either a client certificate, CertificateChain with its
+// PrivateKey, or the TrustedCA bundle upstream certificates are verified
+// against, all PEM encoded. Secrets are served over SDS to the node groups
+// with a cluster using them.
+type Secret struct {
+	Name             string
+	CertificateChain string
+	PrivateKey       string
+	TrustedCA        string
+}
+
+// UpstreamTLS connects a cluster to its endpoints over TLS, presenting SNI.
+// The upstream certificate is verified against the TrustedCA of CASecret,
+// and must carry one of VerifySAN if set. ClientSecret is the certificate
+// sent for mTLS.
+type UpstreamTLS struct {
+	SNI          string
+	CASecret     string
+	ClientSecret string
+	VerifySAN    []string
+}
+
+func (s *Secret) check() error {
+	hasCert := s.CertificateChain != "" || s.PrivateKey != ""
+	if hasCert == (s.TrustedCA != "") {
+		return fmt.Errorf("Secret %s needs one of a CertificateChain with its PrivateKey and a TrustedCA", s.Name)
+	}
+	if hasCert {
+		if _, err := tls.X509KeyPair([]byte(s.CertificateChain), []byte(s.PrivateKey)); err != nil {
+			return fmt.Errorf("Secret %s %s", s.Name, err)
+		}
+		return nil
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM([]byte(s.TrustedCA)) {
+		return fmt.Errorf("Secret %s TrustedCA holds no PEM certificate", s.Name)
+	}
+	return nil
+}
+
+// redacted returns a copy of the secret without its private key.
+func (s *Secret) redacted() *Secret {
+	copied := *s
+	if copied.PrivateKey != "" {
+		copied.PrivateKey = redactedKey
+	}
+	return &copied
+}
+
+func (secrets SecretsMap) redacted() SecretsMap {
+	redacted := make(SecretsMap, len(secrets))
+	for name, s := range secrets {
+		redacted[name] = s.redacted()
+	}
+	return redacted
+}
+
+// names lists the secrets the cluster uses.
+func (t *UpstreamTLS) names() []string {
+	var names []string
+	if t == nil {
+		return names
+	}
+	for _, name := range []string{t.CASecret, t.ClientSecret} {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (t *UpstreamTLS) uses(secret string) bool {
+	return t != nil && (t.CASecret == secret || t.ClientSecret == secret)
+}
+
+// checkTLS makes sure the secrets of a cluster exist and are of the right
+// kind.
+func (cf Configuration) checkTLS(c *Cluster) error {
+	t := c.TLS
+	if t == nil {
+		return nil
+	}
+	if len(t.VerifySAN) > 0 && t.CASecret == "" {
+		return fmt.Errorf("Cluster %s verifies SANs without a CASecret", c.Name)
+	}
+	if t.CASecret != "" {
+		s, ok := cf.Secrets[t.CASecret]
+		if !ok {
+			return fmt.Errorf("Secret %s %w", t.CASecret, ErrNotFound)
+		}
+		if s.TrustedCA == "" {
+			return fmt.Errorf("Cluster %s CASecret %s has no TrustedCA", c.Name, s.Name)
+		}
+	}
+	if t.ClientSecret != "" {
+		s, ok := cf.Secrets[t.ClientSecret]
+		if !ok {
+			return fmt.Errorf("Secret %s %w", t.ClientSecret, ErrNotFound)
+		}
+		if s.CertificateChain == "" {
+			return fmt.Errorf("Cluster %s ClientSecret %s has no CertificateChain", c.Name, s.Name)
+		}
+	}
+	return nil
+}
+
+// SecretRefs lists the clusters using secret.
+func (cf Configuration) SecretRefs(secret string) []string {
+	var refs []string
+	for _, c := range cf.Clusters {
+		if c.TLS.uses(secret) {
+			refs = append(refs, "cluster/"+c.Name)
+		}
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+func (cf Configuration) PutSecret(s *Secret) error {
+	return cf.Execute(Operation{Op: OpPutSecret, Name: s.Name, Secret: s})
+}
+
+func (cf Configuration) DeleteSecret(name string) error {
+	return cf.Execute(Operation{Op: OpDeleteSecret, Name: name})
+}
+
+// putSecret creates or replaces a secret, the clusters using it must still
+// find the kind of secret they need.
+func (cf Configuration) putSecret(s *Secret) error {
+	if s == nil || s.Name == "" {
+		return errors.New("Secret name is required")
+	}
+	if err := s.check(); err != nil {
+		return err
+	}
+	cf.Secrets[s.Name] = s
+	for _, c := range cf.Clusters {
+		if !c.TLS.uses(s.Name) {
+			continue
+		}
+		if err := cf.checkTLS(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteSecret refuses to delete a secret a cluster uses.
+func (cf Configuration) deleteSecret(name string) error {
+	if _, ok := cf.Secrets[name]; !ok {
+		return fmt.Errorf("Secret %s %w", name, ErrNotFound)
+	}
+	if refs := cf.SecretRefs(name); len(refs) > 0 {
+		return fmt.Errorf("Secret %s is %w by %s", name, ErrReferenced, strings.Join(refs, ", "))
+	}
+	delete(cf.Secrets, name)
+	return nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// defaultVHost names the virtual host serving the route rules and cluster
+// for any other domain, no virtual host can take its name.
+const defaultVHost = "local_service"
+
+// names returns the virtual host names in the order they are served.
+func (v VirtualHosts) names() []string {
+	names := make([]string, 0, len(v))
+	for name := range v {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (vh *VHost) check() error {
+	if vh.Name == defaultVHost {
+		return fmt.Errorf("Virtual host name %s is reserved", defaultVHost)
+	}
+	if len(vh.Domains) == 0 {
+		return fmt.Errorf("Virtual host %s has no domains", vh.Name)
+	}
+	return checkRules("Virtual host "+vh.Name, vh.Routes)
+}
+
+// checkRules validates the rules of owner, they are told apart by name.
+func checkRules(owner string, rules []*RouteRule) error {
+	seen := make(map[string]bool)
+	for _, rule := range rules {
+		if rule == nil || rule.Name == "" {
+			return fmt.Errorf("%s: rule name is required", owner)
+		}
+		if seen[rule.Name] {
+			return fmt.Errorf("%s: rule %s is listed twice", owner, rule.Name)
+		}
+		seen[rule.Name] = true
+		if err := rule.check(); err != nil {
+			return fmt.Errorf("%s: rule %s %s", owner, rule.Name, err)
+		}
+	}
+	return nil
+}
+
+func (rule *RouteRule) check() error {
+	if (rule.Cluster == "") == (len(rule.Weights) == 0) {
+		return errors.New("needs one of Cluster and Weights")
+	}
+	if err := checkWeights(rule.Weights); err != nil {
+		return err
+	}
+	paths := 0
+	for _, p := range []string{rule.Path, rule.Prefix, rule.Regex} {
+		if p != "" {
+			paths++
+		}
+	}
+	if paths > 1 {
+		return errors.New("can only match one of Path, Prefix and Regex")
+	}
+	if err := checkRegex(rule.Regex); err != nil {
+		return err
+	}
+	for _, h := range rule.Headers {
+		if err := checkMatch("header", h.Name, h.Exact, h.Regex, h.Present); err != nil {
+			return err
+		}
+	}
+	for _, q := range rule.Query {
+		if err := checkMatch("query parameter", q.Name, q.Exact, q.Regex, q.Present); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkMatch(kind, name, exact, regex string, present bool) error {
+	if name == "" {
+		return fmt.Errorf("has a %s match without a name", kind)
+	}
+	set := 0
+	for _, ok := range []bool{exact != "", regex != "", present} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("%s %s needs one of Exact, Regex and Present", kind, name)
+	}
+	return checkRegex(regex)
+}
+
+// checkRegex rejects regexes Envoy would, RE2 and Go share the syntax.
+func checkRegex(regex string) error {
+	if regex == "" {
+		return nil
+	}
+	if _, err := regexp.Compile(regex); err != nil {
+		return fmt.Errorf("regex: %s", err)
+	}
+	return nil
+}
+
+// routable reports whether r has anything to route to.
+func (r *RouteConf) routable() bool {
+	return r.hasDefault() || len(r.Rules) > 0 || len(r.VirtualHosts) > 0
+}
+
+// hasDefault reports whether r routes the requests no rule matched.
+func (r *RouteConf) hasDefault() bool {
+	return r.Cluster != "" || len(r.Weights) > 0
+}
+
+// checkDomains makes sure every domain is served by a single virtual host,
+// Envoy rejects the route configuration otherwise. The route rules and
+// cluster are served for any other domain.
+func (r *RouteConf) checkDomains() error {
+	owner := make(map[string]string)
+	if r.hasDefault() || len(r.Rules) > 0 {
+		owner["*"] = "the route itself"
+	}
+	for _, name := range r.VirtualHosts.names() {
+		for _, domain := range r.VirtualHosts[name].Domains {
+			if other, ok := owner[domain]; ok {
+				return fmt.Errorf("Route %s: domain %s of virtual host %s is already served by %s", r.Name, domain, name, other)
+			}
+			owner[domain] = "virtual host " + name
+		}
+	}
+	return nil
+}
+
+func (cf Configuration) PutVHost(route string, vh *VHost) error {
+	return cf.Execute(Operation{Op: OpPutVHost, Route: route, Name: vh.Name, VHost: vh})
+}
+
+func (cf Configuration) DeleteVHost(route, name string) error {
+	return cf.Execute(Operation{Op: OpDeleteVHost, Route: route, Name: name})
+}
+
+func (cf Configuration) AddRouteRule(route, vhost string, rule *RouteRule) error {
+	return cf.Execute(Operation{Op: OpAddRouteRule, Route: route, Name: vhost, Rule: rule})
+}
+
+func (cf Configuration) DeleteRouteRule(route, vhost, rule string) error {
+	return cf.Execute(Operation{Op: OpDeleteRouteRule, Route: route, Name: vhost, Rule: &RouteRule{Name: rule}})
+}
+
+// putVHost creates or replaces a virtual host of route, the rules are kept
+// unless vh lists them.
+func (cf Configuration) putVHost(route string, vh *VHost) error {
+	r, ok := cf.RouteConf[route]
+	if !ok {
+		return fmt.Errorf("Route %s %w", route, ErrNotFound)
+	}
+	if vh == nil || vh.Name == "" {
+		return errors.New("Virtual host name is required")
+	}
+	if r.VirtualHosts == nil {
+		r.VirtualHosts = make(VirtualHosts)
+	}
+	if old, ok := r.VirtualHosts[vh.Name]; ok && vh.Routes == nil {
+		vh.Routes = old.Routes
+	}
+	if err := vh.check(); err != nil {
+		return err
+	}
+	if err := cf.checkRuleTargets(vh.Routes); err != nil {
+		return err
+	}
+	r.VirtualHosts[vh.Name] = vh
+	return r.checkDomains()
+}
+
+func (cf Configuration) deleteVHost(route, name string) error {
+	r, ok := cf.RouteConf[route]
+	if !ok {
+		return fmt.Errorf("Route %s %w", route, ErrNotFound)
+	}
+	if _, ok := r.VirtualHosts[name]; !ok {
+		return fmt.Errorf("Virtual host %s %w", name, ErrNotFound)
+	}
+	delete(r.VirtualHosts, name)
+	return nil
+}
+
+func (cf Configuration) vhost(route, name string) (*VHost, error) {
+	r, ok := cf.RouteConf[route]
+	if !ok {
+		return nil, fmt.Errorf("Route %s %w", route, ErrNotFound)
+	}
+	vh, ok := r.VirtualHosts[name]
+	if !ok {
+		return nil, fmt.Errorf("Virtual host %s %w", name, ErrNotFound)
+	}
+	return vh, nil
+}
+
+// addRouteRule appends rule to the rules of a virtual host.
+func (cf Configuration) addRouteRule(route, vhost string, rule *RouteRule) error {
+	vh, err := cf.vhost(route, vhost)
+	if err != nil {
+		return err
+	}
+	if rule == nil {
+		return errors.New("Rule is required")
+	}
+	for _, r := range vh.Routes {
+		if r.Name == rule.Name {
+			return fmt.Errorf("Rule %s already exists", rule.Name)
+		}
+	}
+	if err := cf.checkRuleTargets([]*RouteRule{rule}); err != nil {
+		return err
+	}
+	vh.Routes = append(vh.Routes, rule)
+	return vh.check()
+}
+
+func (cf Configuration) deleteRouteRule(route, vhost string, rule *RouteRule) error {
+	vh, err := cf.vhost(route, vhost)
+	if err != nil {
+		return err
+	}
+	if rule == nil {
+		return errors.New("Rule is required")
+	}
+	for i, r := range vh.Routes {
+		if r.Name == rule.Name {
+			vh.Routes = append(vh.Routes[:i:i], vh.Routes[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("Rule %s %w", rule.Name, ErrNotFound)
+}
+
+// withoutCluster returns rules without the ones sending to cluster, rules
+// splitting traffic are kept while some is left for other clusters.
+func withoutCluster(rules []*RouteRule, cluster string) []*RouteRule {
+	var kept []*RouteRule
+	for _, rule := range rules {
+		if rule.Cluster != cluster && rule.Weights.without(cluster) {
+			kept = append(kept, rule)
+		}
+	}
+	return kept
+}
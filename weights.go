@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+func (w ClusterWeights) names() []string {
+	names := make([]string, 0, len(w))
+	for name := range w {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (w ClusterWeights) has(cluster string) bool {
+	_, ok := w[cluster]
+	return ok
+}
+
+// without drops cluster from w and reports whether any traffic is left to
+// split, which is always the case if cluster was not in w.
+func (w ClusterWeights) without(cluster string) bool {
+	if !w.has(cluster) {
+		return true
+	}
+	delete(w, cluster)
+	return len(w) > 0 && checkWeights(w) == nil
+}
+
+// checkTargets makes sure the cluster, or the clusters of weights, a route
+// or a rule sends its traffic to exist.
+func (cf Configuration) checkTargets(cluster string, weights ClusterWeights) error {
+	targets := weights.names()
+	if cluster != "" {
+		targets = append([]string{cluster}, targets...)
+	}
+	for _, name := range targets {
+		if _, ok := cf.Clusters[name]; !ok {
+			return fmt.Errorf("Cluster %s %w", name, ErrNotFound)
+		}
+	}
+	return nil
+}
+
+func (cf Configuration) checkRuleTargets(rules []*RouteRule) error {
+	for _, rule := range rules {
+		if err := cf.checkTargets(rule.Cluster, rule.Weights); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uses reports whether rule sends any request to cluster.
+func (rule *RouteRule) uses(cluster string) bool {
+	return rule.Cluster == cluster || rule.Weights.has(cluster)
+}
+
+// checkWeights makes sure some traffic is left to split, weights are
+// relative to their sum.
+func checkWeights(w ClusterWeights) error {
+	if len(w) == 0 {
+		return nil
+	}
+	var total uint64
+	for name, weight := range w {
+		if name == "" {
+			return errors.New("weights a cluster without a name")
+		}
+		total += uint64(weight)
+	}
+	if total == 0 {
+		return errors.New("weights add up to 0")
+	}
+	if total > 1<<32-1 {
+		return errors.New("weights add up to more than 4294967295")
+	}
+	return nil
+}
+
+// SetWeights splits the traffic of a rule across clusters, of the default
+// route target if rule is empty. Rules of a virtual host are found by vhost.
+func (cf Configuration) SetWeights(route, vhost, rule string, weights ClusterWeights) error {
+	op := Operation{Op: OpSetWeights, Route: route, Name: vhost, Weights: weights}
+	if rule != "" {
+		op.Rule = &RouteRule{Name: rule}
+	}
+	return cf.Execute(op)
+}
+
+func (cf Configuration) setWeights(route, vhost string, rule *RouteRule, weights ClusterWeights) error {
+	if len(weights) == 0 {
+		return errors.New("Weights are required")
+	}
+	if err := checkWeights(weights); err != nil {
+		return fmt.Errorf("Route %s %s", route, err)
+	}
+	if err := cf.checkTargets("", weights); err != nil {
+		return err
+	}
+	r, ok := cf.RouteConf[route]
+	if !ok {
+		return fmt.Errorf("Route %s %w", route, ErrNotFound)
+	}
+	if rule == nil {
+		if vhost != "" {
+			return errors.New("Virtual hosts have no default cluster, set the weights of a rule")
+		}
+		r.Cluster = ""
+		r.Weights = weights
+		return r.checkDomains()
+	}
+
+	rules := r.Rules
+	if vhost != "" {
+		vh, err := cf.vhost(route, vhost)
+		if err != nil {
+			return err
+		}
+		rules = vh.Routes
+	}
+	for _, target := range rules {
+		if target.Name == rule.Name {
+			target.Cluster = ""
+			target.Weights = weights
+			return nil
+		}
+	}
+	return fmt.Errorf("Rule %s %w", rule.Name, ErrNotFound)
+}